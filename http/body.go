@@ -0,0 +1,39 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// BufferRequestBody reads the body of r into ob, so that it can be read again, for example after it has been validated.
+// It reports whether the whole body was buffered. If it wasn't, a response has been written: http.StatusRequestEntityTooLarge
+// if the body exceeds the MaxSize of ob (which is checked against the Content-Length before anything is read),
+// http.StatusInsufficientStorage if the Budget of ob has been exhausted and http.StatusBadRequest if reading the body
+// failed. The caller remains responsible for closing ob.
+func BufferRequestBody(w http.ResponseWriter, r *http.Request, ob *ioutil.OverflowBuffer) bool {
+	if ob.MaxSize > 0 && r.ContentLength > ob.MaxSize {
+		writeErr(w, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	if _, err := io.Copy(ob, r.Body); err != nil {
+		writeErr(w, BufferErrorStatus(err))
+		return false
+	}
+	return true
+}
+
+// BufferErrorStatus maps an error that occurred while buffering a request body in an ioutil.OverflowBuffer to the
+// status code with which the request should be answered
+func BufferErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ioutil.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ioutil.ErrBudgetExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusBadRequest
+}
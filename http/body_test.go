@@ -0,0 +1,54 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pkgioutil "github.com/rszewczyk/pkg/ioutil"
+)
+
+func TestBufferRequestBody(t *testing.T) {
+	testName := "TestBufferRequestBody"
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ob := &pkgioutil.OverflowBuffer{Capacity: 10, MaxSize: 100}
+		defer ob.Close()
+		if !BufferRequestBody(w, r, ob) {
+			return
+		}
+		body, _ := ioutil.ReadAll(ob)
+		w.Write(body)
+	}))
+	defer svr.Close()
+
+	for i, test := range []struct {
+		body           string
+		unknownLength  bool
+		expectedStatus int
+	}{
+		{strings.Repeat("x", 100), false, http.StatusOK},
+		{strings.Repeat("x", 101), false, http.StatusRequestEntityTooLarge},
+		{strings.Repeat("x", 101), true, http.StatusRequestEntityTooLarge},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, svr.URL, strings.NewReader(test.body))
+		if test.unknownLength {
+			req.Body = ioutil.NopCloser(req.Body)
+			req.ContentLength = -1
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s loop(%d) (1): Expected err to be nil, got %s", testName, i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if test.expectedStatus != res.StatusCode {
+			t.Errorf("%s loop(%d) (2): Expected status code to be %d, got %d", testName, i, test.expectedStatus, res.StatusCode)
+		}
+		if res.StatusCode == http.StatusOK && test.body != string(body) {
+			t.Errorf("%s loop(%d) (3): Expected the buffered body to be echoed, got %d bytes", testName, i, len(body))
+		}
+	}
+}
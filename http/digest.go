@@ -0,0 +1,157 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentDigestHeaderKey is the name of the header or trailer that holds the digest of a request body, as defined by
+// RFC 9530
+const ContentDigestHeaderKey = "Content-Digest"
+
+// Digest algorithms that can be used with PipeOptions.Digest and that are verified by VerifyDigestHandler
+const (
+	DigestSHA256 = "sha-256"
+	DigestCRC32C = "crc32c"
+)
+
+var (
+	// ErrDigestMismatch is returned when reading a request body whose content doesn't match its digest
+	ErrDigestMismatch = errors.New("content digest mismatch")
+	// ErrDigestMissing is returned when reading a request body that announced a Content-Digest trailer without sending it
+	ErrDigestMissing = errors.New("content digest missing")
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newDigestHash(alg string) (hash.Hash, error) {
+	switch strings.ToLower(alg) {
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestCRC32C:
+		return crc32.New(crc32cTable), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %q", alg)
+}
+
+// digestValue formats a digest as a Content-Digest dictionary member
+func digestValue(alg string, sum []byte) string {
+	return strings.ToLower(alg) + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// parseDigests parses a Content-Digest value into a map of algorithm to digest. Malformed members are ignored.
+func parseDigests(v string) map[string][]byte {
+	digests := make(map[string][]byte)
+	for _, member := range strings.Split(v, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			continue
+		}
+		digests[strings.ToLower(alg)] = sum
+	}
+	return digests
+}
+
+// hashingWriter writes to w and adds whatever was written to h
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// VerifyDigestHandler verifies the digests of request bodies that have a Content-Digest header or announce a
+// Content-Digest trailer. The body is hashed as next reads it; once it has been read to the end, reading returns an
+// error wrapping ErrDigestMismatch, rather than io.EOF, if any digest with a supported algorithm doesn't match, or
+// ErrDigestMissing if an announced trailer wasn't sent. Handlers must therefore treat errors reading the body as a
+// failure of the request. Bodies that aren't read to the end aren't verified.
+//
+// The digest covers the body as it was sent, so if it is used with DecompressHandler, VerifyDigestHandler must wrap
+// the DecompressHandler.
+func VerifyDigestHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, announced := r.Trailer[ContentDigestHeaderKey]
+		if r.Header.Get(ContentDigestHeaderKey) == "" && !announced {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		hashes := make(map[string]hash.Hash)
+		for _, alg := range []string{DigestSHA256, DigestCRC32C} {
+			hashes[alg], _ = newDigestHash(alg)
+		}
+		writers := make([]io.Writer, 0, len(hashes))
+		for _, h := range hashes {
+			writers = append(writers, h)
+		}
+
+		r2 := r.WithContext(r.Context())
+		r2.Body = &verifyingBody{
+			ReadCloser: r.Body,
+			r:          io.TeeReader(r.Body, io.MultiWriter(writers...)),
+			req:        r,
+			hashes:     hashes,
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+type verifyingBody struct {
+	io.ReadCloser
+	r      io.Reader
+	req    *http.Request
+	hashes map[string]hash.Hash
+	err    error
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		if verr := b.verify(); verr != nil {
+			err = verr
+		}
+		b.err = err
+	}
+	return n, err
+}
+
+// verify checks the digests once the body has been read to the end, which is when the trailers are available
+func (b *verifyingBody) verify() error {
+	v := b.req.Trailer.Get(ContentDigestHeaderKey)
+	if v == "" {
+		v = b.req.Header.Get(ContentDigestHeaderKey)
+	}
+	if v == "" {
+		return ErrDigestMissing
+	}
+
+	for alg, expected := range parseDigests(v) {
+		h, ok := b.hashes[alg]
+		if !ok {
+			continue
+		}
+		if actual := h.Sum(nil); !bytes.Equal(expected, actual) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrDigestMismatch, digestValue(alg, expected), digestValue(alg, actual))
+		}
+	}
+	return nil
+}
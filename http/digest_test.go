@@ -0,0 +1,93 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newVerifyingServer(readErr *error) *httptest.Server {
+	return httptest.NewServer(VerifyDigestHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, *readErr = ioutil.ReadAll(r.Body); *readErr != nil {
+			http.Error(w, (*readErr).Error(), http.StatusBadRequest)
+		}
+	})))
+}
+
+func TestPipeWriterWithOptionsDigest(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsDigest"
+
+	var readErr error
+	svr := newVerifyingServer(&readErr)
+	defer svr.Close()
+
+	content := bytes.Repeat([]byte("some content"), 10000)
+	for _, alg := range []string{DigestSHA256, DigestCRC32C} {
+		req, _ := http.NewRequest(http.MethodPut, svr.URL, nil)
+		req.ContentLength = int64(len(content))
+		resultCh := make(chan Result, 1)
+		w := PipeWriterWithOptions(nil, req, PipeOptions{Digest: alg, ContentEncoding: "gzip"}, resultCh)
+		w.Write(content)
+		w.Close()
+
+		result := <-resultCh
+		if result.Error != nil {
+			t.Fatalf("%s %s (1): Expected err to be nil, got %s", testName, alg, result.Error)
+		}
+		if err := result.CheckStatus(); err != nil {
+			t.Errorf("%s %s (2): Expected err to be nil, got %s", testName, alg, err)
+		}
+		result.Close()
+		if readErr != nil {
+			t.Errorf("%s %s (3): Expected the digest to be verified, got %s", testName, alg, readErr)
+		}
+		if actual := req.Trailer.Get(ContentDigestHeaderKey); !strings.HasPrefix(actual, alg+"=:") {
+			t.Errorf("%s %s (4): Expected a %s digest trailer, got '%s'", testName, alg, alg, actual)
+		}
+	}
+}
+
+func TestVerifyDigestHandler(t *testing.T) {
+	testName := "TestVerifyDigestHandler"
+
+	var readErr error
+	svr := newVerifyingServer(&readErr)
+	defer svr.Close()
+
+	send := func(trailer string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, svr.URL, ioutil.NopCloser(strings.NewReader("some content")))
+		req.Trailer = http.Header{ContentDigestHeaderKey: nil}
+		if trailer != "" {
+			req.Trailer.Set(ContentDigestHeaderKey, trailer)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error executing request: %s", testName, err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := send(digestValue(DigestSHA256, make([]byte, 32)))
+	if expected, actual := http.StatusBadRequest, res.StatusCode; expected != actual {
+		t.Errorf("%s (1): Expected status code to be %d, got %d", testName, expected, actual)
+	}
+	if !errors.Is(readErr, ErrDigestMismatch) {
+		t.Errorf("%s (2): Expected ErrDigestMismatch, got %v", testName, readErr)
+	}
+
+	send("")
+	if !errors.Is(readErr, ErrDigestMissing) {
+		t.Errorf("%s (3): Expected ErrDigestMissing, got %v", testName, readErr)
+	}
+
+	// digests with unsupported algorithms are ignored
+	send("md5=:AAAA:")
+	if readErr != nil {
+		t.Errorf("%s (4): Expected err to be nil, got %s", testName, readErr)
+	}
+}
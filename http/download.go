@@ -0,0 +1,365 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+const (
+	// DefaultDownloadRetries is the number of consecutive times a Downloader resumes a download when MaxRetries is zero
+	DefaultDownloadRetries = 5
+	// DefaultDownloadRetryDelay is the delay before a Downloader first resumes a download when RetryDelay is zero
+	DefaultDownloadRetryDelay = time.Second
+	// MinParallelChunkSize is the smallest chunk that a Downloader splits a download into
+	MinParallelChunkSize = 1 << 20
+)
+
+// ErrResourceChanged is returned when the resource being downloaded changes before the download is complete
+var ErrResourceChanged = errors.New("resource changed during download")
+
+// DownloadResult represents the result of a download. The embedded Result is that of the last request that was
+// made, whose response body has been closed, except that Error is the error of the download as a whole.
+type DownloadResult struct {
+	Result
+	// Written is the number of bytes written and Size is the size of the resource, or -1 if it isn't known
+	Written, Size int64
+	// ETag is the strong entity tag of the resource, if it has one
+	ETag string
+	// Resumes is the number of times that the download was resumed after a failure
+	Resumes int
+	// Chunks is the number of parallel chunks that the download was split into, or 1 if it wasn't split
+	Chunks int
+}
+
+// Downloader downloads resources, resuming downloads that fail by requesting the remainder of the resource with a
+// Range request. An If-Range header holding the resource's entity tag (or its modification time if it doesn't have a
+// strong entity tag) ensures that the resource hasn't changed in the meantime. The length of the content received is
+// checked against the size of the resource.
+type Downloader struct {
+	// Client is used to send requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// MaxRetries is the number of consecutive failures after which a download is abandoned. If zero,
+	// DefaultDownloadRetries is used.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, which doubles with each consecutive failure. If zero,
+	// DefaultDownloadRetryDelay is used.
+	RetryDelay time.Duration
+	// Parallelism, if greater than one, is the number of chunks that a download is split into and that are downloaded
+	// in parallel, if the server supports Range requests and the resource is large enough. Each chunk is buffered in
+	// an ioutil.OverflowBuffer, configured by Capacity, Dir and Prefix, until the chunks before it have been written.
+	Parallelism int
+	Capacity    int
+	Dir, Prefix string
+}
+
+// Download executes req, which must be a GET request without a body, and writes the response body to w. w may, for
+// example, be an ioutil.OverflowBuffer. The download is abandoned if ctx is done.
+func (d *Downloader) Download(ctx context.Context, req *http.Request, w io.Writer) DownloadResult {
+	if d.Parallelism > 1 {
+		if dr, ok := d.downloadParallel(ctx, req, w); ok {
+			return dr
+		}
+	}
+
+	f := &rangeFetch{d: d, req: req, end: -1}
+	written, err := f.fetch(ctx, w)
+	dr := DownloadResult{Result: f.last, Written: written, Size: f.end, ETag: f.v.etag, Resumes: f.resumes, Chunks: 1}
+	dr.Error = err
+	return dr
+}
+
+// downloadParallel downloads req in parallel chunks. It returns false, without having written anything, if the
+// download can't be split into chunks.
+func (d *Downloader) downloadParallel(ctx context.Context, req *http.Request, w io.Writer) (dr DownloadResult, ok bool) {
+	head := req.Clone(ctx)
+	head.Method = http.MethodHead
+	res, err := d.client().Do(head)
+	result := Result{Response: res, Request: head, Error: err}
+	defer result.Close()
+	if result.CheckStatus() != nil || res.Header.Get("Accept-Ranges") != "bytes" {
+		return
+	}
+	v := validatorOf(res)
+	size := res.ContentLength
+	if v.ifRange() == "" || size < 2*MinParallelChunkSize {
+		return
+	}
+
+	chunks := d.Parallelism
+	if max := int(size / MinParallelChunkSize); chunks > max {
+		chunks = max
+	}
+	chunkSize := (size + int64(chunks) - 1) / int64(chunks)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type chunk struct {
+		f    *rangeFetch
+		ob   *ioutil.OverflowBuffer
+		err  error
+		done chan struct{}
+	}
+	cs := make([]*chunk, chunks)
+	for i := range cs {
+		start := int64(i) * chunkSize
+		end := start + chunkSize
+		if end > size {
+			end = size
+		}
+		c := &chunk{
+			f:    &rangeFetch{d: d, req: req, start: start, end: end, v: v},
+			ob:   &ioutil.OverflowBuffer{Capacity: d.Capacity, Dir: d.Dir, Prefix: d.Prefix},
+			done: make(chan struct{}),
+		}
+		cs[i] = c
+		go func() {
+			defer close(c.done)
+			_, c.err = c.f.fetch(ctx, c.ob)
+		}()
+	}
+
+	// chunks are written in order as soon as they are complete
+	dr = DownloadResult{Size: size, ETag: v.etag, Chunks: chunks}
+	for _, c := range cs {
+		<-c.done
+		dr.Result = c.f.last
+		dr.Resumes += c.f.resumes
+		if err == nil {
+			err = c.err
+		}
+		if err == nil {
+			var n int64
+			n, err = io.Copy(w, c.ob)
+			dr.Written += n
+		}
+		if err != nil {
+			cancel()
+		}
+		c.ob.Close()
+	}
+	dr.Error = err
+	return dr, true
+}
+
+func (d *Downloader) client() *http.Client {
+	if d.Client == nil {
+		return http.DefaultClient
+	}
+	return d.Client
+}
+
+// validator identifies a version of a resource
+type validator struct {
+	set                bool
+	etag, lastModified string
+}
+
+func validatorOf(res *http.Response) validator {
+	v := validator{set: true, lastModified: res.Header.Get("Last-Modified")}
+	// only strong entity tags can be used with If-Range
+	if etag := res.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		v.etag = etag
+	}
+	return v
+}
+
+func (v validator) ifRange() string {
+	if v.etag != "" {
+		return v.etag
+	}
+	return v.lastModified
+}
+
+func (v validator) matches(res *http.Response) bool {
+	o := validatorOf(res)
+	if v.etag != "" || o.etag != "" {
+		return v.etag == o.etag
+	}
+	return v.lastModified == o.lastModified
+}
+
+// rangeFetch downloads the bytes of a resource from start up to end (or to the end of the resource if end is
+// negative), resuming after failures
+type rangeFetch struct {
+	d          *Downloader
+	req        *http.Request
+	start, end int64
+	v          validator
+
+	last    Result
+	resumes int
+}
+
+func (f *rangeFetch) fetch(ctx context.Context, w io.Writer) (written int64, err error) {
+	maxRetries, delay := f.d.MaxRetries, f.d.RetryDelay
+	if maxRetries <= 0 {
+		maxRetries = DefaultDownloadRetries
+	}
+	if delay <= 0 {
+		delay = DefaultDownloadRetryDelay
+	}
+
+	pos := f.start
+	for failures := 0; f.end < 0 || pos < f.end; {
+		var n int64
+		n, err = f.fetchFrom(ctx, w, pos)
+		pos += n
+		if err == nil {
+			return pos - f.start, nil
+		}
+		if n > 0 {
+			failures = 0
+		}
+		if werr, ok := err.(*writeError); ok {
+			return pos - f.start, werr.err
+		}
+		if !isRetryableDownloadErr(ctx, err) || failures >= maxRetries {
+			return pos - f.start, err
+		}
+
+		failures++
+		t := time.NewTimer(delay << (failures - 1))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return pos - f.start, ctx.Err()
+		}
+		f.resumes++
+	}
+	return pos - f.start, nil
+}
+
+// writeError is an error writing the content, which isn't retried
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+// fetchFrom makes a single request for the content from pos onwards. It returns nil if the content is complete.
+func (f *rangeFetch) fetchFrom(ctx context.Context, w io.Writer, pos int64) (int64, error) {
+	req := f.req.Clone(ctx)
+	if pos > 0 || f.end >= 0 {
+		rng := fmt.Sprintf("bytes=%d-", pos)
+		if f.end >= 0 {
+			rng += strconv.FormatInt(f.end-1, 10)
+		}
+		req.Header.Set("Range", rng)
+		if f.v.set && f.v.ifRange() != "" {
+			req.Header.Set("If-Range", f.v.ifRange())
+		}
+	}
+
+	traced, timings := TraceTimings(req)
+	res, err := f.d.client().Do(traced)
+	f.last = Result{Response: res, Request: req, Error: err}
+	defer func() {
+		f.last.Timings = timings()
+		f.last.Close()
+	}()
+	if err := f.last.CheckStatus(); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, err
+		}
+		if start != pos {
+			return 0, fmt.Errorf("expected content range to start at %d, got %d", pos, start)
+		}
+		if f.v.set && !f.v.matches(res) {
+			return 0, ErrResourceChanged
+		}
+		size = total
+	default:
+		// the full resource was sent, either because it was requested or because it has changed
+		if f.v.set && !f.v.matches(res) {
+			return 0, ErrResourceChanged
+		}
+		if _, err := io.CopyN(io.Discard, res.Body, pos); err != nil {
+			return 0, err
+		}
+		size = res.ContentLength
+	}
+
+	if !f.v.set {
+		f.v = validatorOf(res)
+	}
+	if size >= 0 {
+		if f.end < 0 {
+			f.end = size
+		} else if f.end > size {
+			return 0, ErrResourceChanged
+		}
+	}
+
+	body := io.Reader(res.Body)
+	if f.end >= 0 {
+		body = io.LimitReader(body, f.end-pos)
+	}
+	er := &errorRecordingReader{r: body}
+	n, err := io.Copy(w, er)
+	switch {
+	case err != nil && er.err == nil:
+		return n, &writeError{err}
+	case err != nil:
+		return n, err
+	case f.end >= 0 && pos+n < f.end:
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// parseContentRange parses the value of a Content-Range header of the form "bytes start-end/total", where total may
+// be "*", in which case it is returned as -1
+func parseContentRange(v string) (start, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", v)
+	rng, size, ok := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !ok {
+		return 0, 0, invalid
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, invalid
+	}
+	if size == "*" {
+		return start, -1, nil
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, invalid
+	}
+	return
+}
+
+func isRetryableDownloadErr(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrResourceChanged) {
+		return false
+	}
+	var se *StatusError
+	if !errors.As(err, &se) {
+		// the request failed without a response, or reading the response failed
+		return true
+	}
+	switch se.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return se.StatusCode >= 500 && se.StatusCode != http.StatusNotImplemented
+}
@@ -0,0 +1,151 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rszewczyk/pkg/http/transport"
+)
+
+// abortingWriter aborts the response once n bytes have been written
+type abortingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *abortingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.ResponseWriter.Write(p[:w.n])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.n -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// flakyContentServer serves content with http.ServeContent. The first failures responses are aborted after
+// abortAfter bytes.
+type flakyContentServer struct {
+	mu         sync.Mutex
+	content    []byte
+	etag       string
+	failures   int
+	abortAfter int
+	requests   int
+}
+
+func (s *flakyContentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, etag := s.content, s.etag
+	if r.Method == http.MethodGet {
+		s.requests++
+		if s.failures > 0 {
+			s.failures--
+			w = &abortingWriter{w, s.abortAfter}
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+func randomContent(n int) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(content)
+	return content
+}
+
+func TestDownloaderResumes(t *testing.T) {
+	testName := "TestDownloaderResumes"
+
+	fs := &flakyContentServer{content: randomContent(100000), etag: `"v1"`, failures: 2, abortAfter: 30000}
+	svr := httptest.NewServer(fs)
+	defer svr.Close()
+
+	var buf bytes.Buffer
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	d := &Downloader{RetryDelay: time.Millisecond}
+	dr := d.Download(context.Background(), req, &buf)
+	if dr.Error != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, dr.Error)
+	}
+	if !bytes.Equal(fs.content, buf.Bytes()) {
+		t.Errorf("%s (2): Expected the downloaded content to be the same, got %d bytes", testName, buf.Len())
+	}
+	if expected, actual := int64(len(fs.content)), dr.Written; expected != actual || dr.Size != actual {
+		t.Errorf("%s (3): Expected written and size to be %d, got %d and %d", testName, expected, actual, dr.Size)
+	}
+	if expected, actual := 2, dr.Resumes; expected != actual {
+		t.Errorf("%s (4): Expected %d resumes, got %d", testName, expected, actual)
+	}
+	if expected, actual := `"v1"`, dr.ETag; expected != actual {
+		t.Errorf("%s (5): Expected ETag to be %s, got %s", testName, expected, actual)
+	}
+	if expected, actual := http.StatusPartialContent, dr.Response.StatusCode; expected != actual {
+		t.Errorf("%s (6): Expected the last response to have status %d, got %d", testName, expected, actual)
+	}
+}
+
+func TestDownloaderResourceChanged(t *testing.T) {
+	testName := "TestDownloaderResourceChanged"
+
+	fs := &flakyContentServer{content: randomContent(100000), etag: `"v1"`, failures: 1, abortAfter: 30000}
+	svr := httptest.NewServer(fs)
+	defer svr.Close()
+
+	var buf bytes.Buffer
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	d := &Downloader{RetryDelay: time.Millisecond}
+
+	// the content changes after the first request is aborted
+	client := *http.DefaultClient
+	client.Transport = transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Range") != "" {
+			fs.mu.Lock()
+			fs.content, fs.etag = randomContent(50000), `"v2"`
+			fs.mu.Unlock()
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	d.Client = &client
+
+	if dr := d.Download(context.Background(), req, &buf); !errors.Is(dr.Error, ErrResourceChanged) {
+		t.Errorf("%s (1): Expected ErrResourceChanged, got %v", testName, dr.Error)
+	}
+}
+
+func TestDownloaderParallel(t *testing.T) {
+	testName := "TestDownloaderParallel"
+
+	fs := &flakyContentServer{content: randomContent(3*MinParallelChunkSize + 1000), etag: `"v1"`, failures: 1, abortAfter: 100000}
+	svr := httptest.NewServer(fs)
+	defer svr.Close()
+
+	var buf bytes.Buffer
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	d := &Downloader{RetryDelay: time.Millisecond, Parallelism: 4, Capacity: 1 << 16}
+	dr := d.Download(context.Background(), req, &buf)
+	if dr.Error != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, dr.Error)
+	}
+	if !bytes.Equal(fs.content, buf.Bytes()) {
+		t.Errorf("%s (2): Expected the downloaded content to be the same, got %d bytes", testName, buf.Len())
+	}
+	if expected, actual := 3, dr.Chunks; expected != actual {
+		t.Errorf("%s (3): Expected the download to be split into %d chunks, got %d", testName, expected, actual)
+	}
+	if expected, actual := 1, dr.Resumes; expected != actual {
+		t.Errorf("%s (4): Expected %d resumes, got %d", testName, expected, actual)
+	}
+	if expected, actual := 4, fs.requests; expected != actual {
+		t.Errorf("%s (5): Expected %d GET requests, got %d", testName, expected, actual)
+	}
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Encoding is a content coding that can be used to compress request bodies with PipeWriterWithOptions and to
+// decompress them with DecompressHandler
+type Encoding struct {
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]Encoding{
+		"gzip": {
+			NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		},
+		"deflate": {
+			NewWriter: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+		},
+	}
+)
+
+// RegisterEncoding makes an encoding available under the given content coding name, replacing any encoding that was
+// previously registered under that name. The gzip and deflate codings are registered by default; codings such as zstd,
+// which have no standard library implementation, can be registered using a third party package.
+func RegisterEncoding(name string, e Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[strings.ToLower(name)] = e
+}
+
+func lookupEncoding(name string) (Encoding, error) {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	e, ok := encodings[strings.ToLower(name)]
+	if !ok {
+		return Encoding{}, fmt.Errorf("unsupported content encoding %q", name)
+	}
+	return e, nil
+}
+
+// DecompressHandler decodes request bodies that have a Content-Encoding header before calling next.ServeHTTP. The
+// Content-Encoding header is removed and ContentLength is set to -1. If the decoded body exceeds maxSize bytes then
+// reading it fails with an *http.MaxBytesError, so that a small compressed body can't be used to make the server
+// process an arbitrarily large one. If a coding hasn't been registered with RegisterEncoding the DecompressHandler
+// will respond with http.StatusUnsupportedMediaType.
+func DecompressHandler(maxSize int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var codings []string
+		for _, v := range r.Header.Values("Content-Encoding") {
+			for _, coding := range strings.Split(v, ",") {
+				if coding = strings.TrimSpace(coding); coding != "" && !strings.EqualFold(coding, "identity") {
+					codings = append(codings, coding)
+				}
+			}
+		}
+		if len(codings) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// codings are listed in the order in which they were applied, so they are decoded in reverse
+		body := r.Body
+		for i := len(codings) - 1; i >= 0; i-- {
+			e, err := lookupEncoding(codings[i])
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType)+": "+err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			dec, err := e.NewReader(body)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest)+": invalid "+codings[i]+" body", http.StatusBadRequest)
+				return
+			}
+			defer dec.Close()
+			body = dec
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.Header.Del("Content-Encoding")
+		r2.ContentLength = -1
+		r2.Body = http.MaxBytesReader(w, body, maxSize)
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPipeWriterWithOptionsCompression(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsCompression"
+
+	content := bytes.Repeat([]byte("some compressible content"), 10000)
+	for _, encoding := range []string{"gzip", "deflate"} {
+		svr := httptest.NewServer(DecompressHandler(int64(len(content)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if actual := r.Header.Get("Content-Encoding"); actual != "" {
+				t.Errorf("%s %s (1): Expected Content-Encoding to be removed, got '%s'", testName, encoding, actual)
+			}
+			actual, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("%s %s (2): Expected err to be nil, got %s", testName, encoding, err)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Errorf("%s %s (3): Expected %d bytes of decompressed content, got %d", testName, encoding, len(content), len(actual))
+			}
+		})))
+
+		var sent int64
+		req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+		resultCh := make(chan Result, 1)
+		w := PipeWriterWithOptions(nil, req, PipeOptions{ContentEncoding: encoding, OnProgress: func(p Progress) { sent = p.Sent }}, resultCh)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			t.Errorf("%s %s (4): Expected err to be nil, got %s", testName, encoding, err)
+		}
+
+		result := <-resultCh
+		if result.Error != nil {
+			t.Fatalf("%s %s (5): Expected err to be nil, got %s", testName, encoding, result.Error)
+		}
+		if err := result.CheckStatus(); err != nil {
+			t.Errorf("%s %s (6): Expected err to be nil, got %s", testName, encoding, err)
+		}
+		result.Close()
+		if expected := int64(len(content)); expected != sent {
+			t.Errorf("%s %s (7): Expected progress to count %d uncompressed bytes, got %d", testName, encoding, expected, sent)
+		}
+		svr.Close()
+	}
+}
+
+func TestPipeWriterWithOptionsUnknownEncoding(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsUnknownEncoding"
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	resultCh := make(chan Result, 1)
+	w := PipeWriterWithOptions(nil, req, PipeOptions{ContentEncoding: "unknown"}, resultCh)
+	if _, err := w.Write([]byte("some content")); err == nil {
+		t.Errorf("%s (1): Expected an error", testName)
+	}
+	if result := <-resultCh; result.Error == nil {
+		t.Errorf("%s (2): Expected an error", testName)
+	}
+}
+
+func TestDecompressHandler(t *testing.T) {
+	testName := "TestDecompressHandler"
+
+	var readErr error
+	svr := httptest.NewServer(DecompressHandler(100, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	})))
+	defer svr.Close()
+
+	// 1000 bytes compress to far fewer than the 100 byte limit, but decompress to more
+	req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+	resultCh := make(chan Result, 1)
+	w := PipeWriterWithOptions(nil, req, PipeOptions{ContentEncoding: "gzip"}, resultCh)
+	w.Write([]byte(strings.Repeat("x", 1000)))
+	w.Close()
+	result := <-resultCh
+	if result.Error != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, result.Error)
+	}
+	result.Close()
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(readErr, &maxBytesErr) {
+		t.Errorf("%s (2): Expected an *http.MaxBytesError, got %v", testName, readErr)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, svr.URL, strings.NewReader("some content"))
+	req.Header.Set("Content-Encoding", "br")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s (3): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+	if expected, actual := http.StatusUnsupportedMediaType, res.StatusCode; expected != actual {
+		t.Errorf("%s (4): Expected status code to be %d, got %d", testName, expected, actual)
+	}
+}
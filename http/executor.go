@@ -0,0 +1,206 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Executor executes a stream of requests with bounded concurrency
+type Executor struct {
+	// Client is used to execute requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Concurrency is the maximum number of requests that are executed at once. If less than 1, 1 is used.
+	Concurrency int
+	// PerHost is the maximum number of requests to any one host that are executed at once. If zero there is no
+	// limit per host.
+	PerHost int
+	// Ordered causes results to be delivered in the order that requests were received rather than as they complete
+	Ordered bool
+}
+
+type sequencedResult struct {
+	seq    int
+	result Result
+}
+
+// Run executes each request received from reqs, which keep their own contexts but are also cancelled when ctx is
+// done, and delivers a Result for each on the returned channel. A request counts towards the concurrency limits from
+// the time it is received until its result has been delivered, so a consumer that stops receiving results will stop
+// Run from receiving requests.
+//
+// The returned channel is closed once reqs has been closed and all results have been delivered, or once ctx is done.
+// Results that can't be delivered because ctx is done have their response bodies closed.
+func (e *Executor) Run(ctx context.Context, reqs <-chan *http.Request) <-chan Result {
+	concurrency := e.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		out       = make(chan Result)
+		slots     = make(chan struct{}, concurrency)
+		hosts     = &hostLimiter{limit: e.PerHost}
+		completed chan sequencedResult
+		wg        sync.WaitGroup
+	)
+
+	deliver := func(r Result) {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			r.Close()
+		}
+		<-slots
+	}
+
+	if e.Ordered {
+		// there can't be more than concurrency results that have completed but not been delivered, so sends on
+		// completed never block
+		completed = make(chan sequencedResult, concurrency)
+		go func() {
+			defer close(out)
+			pending := make(map[int]Result)
+			next := 0
+			for sr := range completed {
+				pending[sr.seq] = sr.result
+				for r, ok := pending[next]; ok; r, ok = pending[next] {
+					delete(pending, next)
+					next++
+					deliver(r)
+				}
+			}
+			for _, r := range pending {
+				r.Close()
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			wg.Wait()
+			if completed != nil {
+				close(completed)
+			} else {
+				close(out)
+			}
+		}()
+
+		for seq := 0; ; seq++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			var (
+				req *http.Request
+				ok  bool
+			)
+			select {
+			case req, ok = <-reqs:
+			case <-ctx.Done():
+			}
+			if !ok {
+				<-slots
+				return
+			}
+
+			wg.Add(1)
+			go func(seq int, req *http.Request) {
+				defer wg.Done()
+				r := e.do(ctx, hosts, req)
+				if completed != nil {
+					completed <- sequencedResult{seq, r}
+					return
+				}
+				deliver(r)
+			}(seq, req)
+		}
+	}()
+
+	return out
+}
+
+func (e *Executor) do(ctx context.Context, hosts *hostLimiter, req *http.Request) Result {
+	c := e.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	if err := hosts.acquire(ctx, req.URL.Host); err != nil {
+		return Result{Request: req, Error: err}
+	}
+	defer hosts.release(req.URL.Host)
+
+	// the request keeps its own deadline and values, and is also cancelled when ctx is done, until its response body
+	// has been closed
+	reqCtx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(ctx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	traced, timings := TraceTimings(req.WithContext(reqCtx))
+	res, err := c.Do(traced)
+	if err != nil {
+		release()
+	} else {
+		res.Body = &releaseOnClose{ReadCloser: res.Body, release: release}
+	}
+	return Result{Response: res, Request: req, Error: err, Timings: timings()}
+}
+
+// releaseOnClose calls release once the body has been closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// hostLimiter limits the number of requests in flight to each host
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func (l *hostLimiter) hostSlots(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.slots == nil {
+		l.slots = make(map[string]chan struct{})
+	}
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[host] = slots
+	}
+	return slots
+}
+
+func (l *hostLimiter) acquire(ctx context.Context, host string) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	select {
+	case l.hostSlots(host) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *hostLimiter) release(host string) {
+	if l.limit <= 0 {
+		return
+	}
+	<-l.hostSlots(host)
+}
@@ -0,0 +1,200 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rszewczyk/pkg/http/transport"
+)
+
+// concurrencyServer sleeps for the number of milliseconds given by the "sleep" query parameter and records the
+// maximum number of requests that it handled at once
+type concurrencyServer struct {
+	*httptest.Server
+	mu            sync.Mutex
+	current, peak int
+}
+
+func newConcurrencyServer() *concurrencyServer {
+	s := new(concurrencyServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.current++
+		if s.current > s.peak {
+			s.peak = s.current
+		}
+		s.mu.Unlock()
+
+		ms, _ := strconv.Atoi(r.URL.Query().Get("sleep"))
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+
+		s.mu.Lock()
+		s.current--
+		s.mu.Unlock()
+	}))
+	return s
+}
+
+func (s *concurrencyServer) maxConcurrent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+func sendRequests(urls ...string) <-chan *http.Request {
+	reqs := make(chan *http.Request)
+	go func() {
+		defer close(reqs)
+		for _, u := range urls {
+			req, _ := http.NewRequest(http.MethodGet, u, nil)
+			reqs <- req
+		}
+	}()
+	return reqs
+}
+
+func TestExecutorOrdered(t *testing.T) {
+	testName := "TestExecutorOrdered"
+
+	svr := newConcurrencyServer()
+	defer svr.Close()
+
+	var urls []string
+	for i := 0; i < 10; i++ {
+		urls = append(urls, fmt.Sprintf("%s?sleep=%d", svr.URL, (10-i)*5))
+	}
+
+	e := &Executor{Concurrency: 4, Ordered: true}
+	i := 0
+	for result := range e.Run(context.Background(), sendRequests(urls...)) {
+		result.Close()
+		if result.Error != nil {
+			t.Errorf("%s (1): Expected result.Error to be nil, got %s", testName, result.Error)
+		}
+		if i < len(urls) && result.Request.URL.String() != urls[i] {
+			t.Errorf("%s (2): Expected result %d to be for %s, got %s", testName, i, urls[i], result.Request.URL)
+		}
+		i++
+	}
+
+	if i != len(urls) {
+		t.Errorf("%s (3): Expected %d results, got %d", testName, len(urls), i)
+	}
+	if peak := svr.maxConcurrent(); peak > e.Concurrency {
+		t.Errorf("%s (4): Expected at most %d concurrent requests, got %d", testName, e.Concurrency, peak)
+	}
+}
+
+func TestExecutorPerHost(t *testing.T) {
+	testName := "TestExecutorPerHost"
+
+	first, second := newConcurrencyServer(), newConcurrencyServer()
+	defer first.Close()
+	defer second.Close()
+
+	var urls []string
+	for i := 0; i < 10; i++ {
+		urls = append(urls, first.URL+"?sleep=10", second.URL+"?sleep=10")
+	}
+
+	e := &Executor{Concurrency: 6, PerHost: 2}
+	n := 0
+	for result := range e.Run(context.Background(), sendRequests(urls...)) {
+		result.Close()
+		n++
+	}
+
+	if n != len(urls) {
+		t.Errorf("%s (1): Expected %d results, got %d", testName, len(urls), n)
+	}
+	for i, svr := range []*concurrencyServer{first, second} {
+		if peak := svr.maxConcurrent(); peak > e.PerHost {
+			t.Errorf("%s (2): Expected at most %d concurrent requests to server %d, got %d", testName, e.PerHost, i, peak)
+		}
+	}
+}
+
+func TestExecutorBackpressureAndCancel(t *testing.T) {
+	testName := "TestExecutorBackpressureAndCancel"
+
+	svr := newConcurrencyServer()
+	defer svr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := new(int32)
+	reqs := make(chan *http.Request)
+	go func() {
+		for {
+			req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+			select {
+			case reqs <- req:
+				atomic.AddInt32(received, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := (&Executor{Concurrency: 3}).Run(ctx, reqs)
+
+	// nothing is consuming results, so no more than Concurrency requests should be taken
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(received); n > 3 {
+		t.Errorf("%s (1): Expected at most 3 requests to have been received, got %d", testName, n)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-results:
+		for ok {
+			_, ok = <-results
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%s (2): Expected the results channel to be closed after cancellation", testName)
+	}
+}
+
+type executorTestKey struct{}
+
+func TestExecutorRequestContext(t *testing.T) {
+	testName := "TestExecutorRequestContext"
+	svr := newConcurrencyServer()
+	defer svr.Close()
+
+	var sawValue int32
+	e := &Executor{Client: &http.Client{Transport: transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Context().Value(executorTestKey{}) == "value" {
+			atomic.AddInt32(&sawValue, 1)
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), executorTestKey{}, "value"), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL+"?sleep=500", nil)
+	reqs := make(chan *http.Request, 1)
+	reqs <- req
+	close(reqs)
+
+	start := time.Now()
+	for r := range e.Run(context.Background(), reqs) {
+		if !errors.Is(r.Error, context.DeadlineExceeded) {
+			t.Errorf("%s (1): Expected the request's deadline to be exceeded, got %v", testName, r.Error)
+		}
+		r.Close()
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("%s (2): Expected the request's deadline to be kept, took %s", testName, elapsed)
+	}
+	if atomic.LoadInt32(&sawValue) != 1 {
+		t.Errorf("%s (3): Expected the request's context values to be kept", testName)
+	}
+}
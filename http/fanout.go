@@ -0,0 +1,216 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// FanoutMode determines how the writer returned by FanoutPipeWriter reacts when one of its targets fails or falls behind
+type FanoutMode int
+
+const (
+	// AbortAll aborts the request to every target as soon as any one of them fails or lags
+	AbortAll FanoutMode = iota
+	// DropFailed stops writing to a target that fails or lags and continues writing to the rest
+	DropFailed
+	// BufferLagging writes the remainder of the body for a lagging target to an ioutil.OverflowBuffer, which is sent on
+	// to the target once the writer has been closed. Targets that fail are dropped.
+	BufferLagging
+)
+
+var (
+	// ErrTargetLagging is the error with which a request is aborted when its target has not accepted a write within
+	// FanoutPolicy.LagTimeout
+	ErrTargetLagging = errors.New("fanout target is lagging")
+	// ErrFanoutAborted is the error with which requests are aborted when another target fails in AbortAll mode
+	ErrFanoutAborted = errors.New("fanout aborted")
+)
+
+// FanoutPolicy configures the writer returned by FanoutPipeWriter
+type FanoutPolicy struct {
+	Mode FanoutMode
+	// LagTimeout is the amount of time a single write may block on a target before that target is considered to
+	// be lagging. If LagTimeout is zero targets are never considered to be lagging.
+	LagTimeout time.Duration
+	// Capacity, Dir and Prefix configure the OverflowBuffers that are used to buffer lagging targets in BufferLagging mode
+	Capacity    int
+	Dir, Prefix string
+}
+
+// FanoutPipeWriter is a multi-target version of PipeWriter. Everything written to w is streamed as the body of each
+// of reqs, which are executed using c (if c is nil then http.DefaultClient will be used). Callers must close w when
+// finished writing. One result per request will be placed on resultCh. Write returns an error once the body can no
+// longer be delivered to any target, as determined by policy.
+func FanoutPipeWriter(c *http.Client, reqs []*http.Request, policy FanoutPolicy, resultCh chan<- Result) (w io.WriteCloser) {
+	fw := &fanoutWriter{policy: policy}
+	for _, req := range reqs {
+		fw.targets = append(fw.targets, &fanoutTarget{pw: pipeWriter(c, req, resultCh)})
+	}
+	return fw
+}
+
+type fanoutTarget struct {
+	pw *io.PipeWriter
+	// ob is non-nil once the target has started lagging in BufferLagging mode, in which case pending will
+	// receive the result of the write that was in flight when the target started lagging
+	ob      *ioutil.OverflowBuffer
+	pending chan error
+	dropped bool
+}
+
+type fanoutWriter struct {
+	policy  FanoutPolicy
+	targets []*fanoutTarget
+	err     error
+	closed  bool
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if fw.err != nil {
+		return 0, fw.err
+	}
+
+	// a write that outlives the call to Write must not retain p
+	buf := p
+	if fw.policy.LagTimeout > 0 {
+		buf = append([]byte(nil), p...)
+	}
+
+	done := make([]chan error, len(fw.targets))
+	for i, t := range fw.targets {
+		switch {
+		case t.dropped:
+		case t.ob != nil:
+			if _, err := t.ob.Write(p); err != nil {
+				fw.drop(t, err)
+			}
+		default:
+			done[i] = make(chan error, 1)
+			go func(pw *io.PipeWriter, ch chan<- error) {
+				_, err := pw.Write(buf)
+				ch <- err
+			}(t.pw, done[i])
+		}
+	}
+
+	var timeout <-chan time.Time
+	if fw.policy.LagTimeout > 0 {
+		timer := time.NewTimer(fw.policy.LagTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	expired := false
+	for i, t := range fw.targets {
+		if done[i] == nil || t.dropped {
+			continue
+		}
+
+		var err error
+		select {
+		case err = <-done[i]:
+		default:
+			if expired {
+				fw.lag(t, done[i])
+				continue
+			}
+			select {
+			case err = <-done[i]:
+			case <-timeout:
+				expired = true
+				fw.lag(t, done[i])
+				continue
+			}
+		}
+		if err != nil {
+			fw.fail(t, err)
+		}
+	}
+
+	if fw.err != nil {
+		return 0, fw.err
+	}
+	return len(p), nil
+}
+
+func (fw *fanoutWriter) fail(t *fanoutTarget, err error) {
+	if fw.policy.Mode == AbortAll {
+		fw.abort()
+		return
+	}
+	fw.drop(t, err)
+}
+
+func (fw *fanoutWriter) lag(t *fanoutTarget, pending chan error) {
+	switch fw.policy.Mode {
+	case AbortAll:
+		fw.abort()
+	case DropFailed:
+		fw.drop(t, ErrTargetLagging)
+	case BufferLagging:
+		t.ob = &ioutil.OverflowBuffer{Capacity: fw.policy.Capacity, Dir: fw.policy.Dir, Prefix: fw.policy.Prefix}
+		t.pending = pending
+	}
+}
+
+func (fw *fanoutWriter) drop(t *fanoutTarget, err error) {
+	t.dropped = true
+	t.pw.CloseWithError(err)
+	if t.ob != nil {
+		t.ob.Close()
+		t.ob = nil
+	}
+
+	for _, t := range fw.targets {
+		if !t.dropped {
+			return
+		}
+	}
+	fw.err = err
+}
+
+func (fw *fanoutWriter) abort() {
+	fw.err = ErrFanoutAborted
+	for _, t := range fw.targets {
+		if !t.dropped {
+			fw.drop(t, ErrFanoutAborted)
+		}
+	}
+}
+
+// Close closes the request body of each target that is still being written to. Lagging targets continue to
+// receive their buffered data after Close returns.
+func (fw *fanoutWriter) Close() error {
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+
+	for _, t := range fw.targets {
+		switch {
+		case t.dropped:
+		case t.ob != nil:
+			go flushLagging(t.pw, t.ob, t.pending)
+		default:
+			t.pw.Close()
+		}
+	}
+	return fw.err
+}
+
+func flushLagging(pw *io.PipeWriter, ob *ioutil.OverflowBuffer, pending <-chan error) {
+	defer ob.Close()
+
+	err := <-pending
+	if err == nil {
+		_, err = io.Copy(pw, ob)
+	}
+	pw.CloseWithError(err)
+}
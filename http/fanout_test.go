@@ -0,0 +1,172 @@
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rszewczyk/pkg/http/transport"
+)
+
+// slowClient returns a client that waits for delay before starting to send requests to host
+func slowClient(host string, delay time.Duration) *http.Client {
+	return &http.Client{Transport: transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == host {
+			time.Sleep(delay)
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+}
+
+func newFanoutServer(t *testing.T, testName string, expectedContent []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// bodies of aborted requests are expected to be incomplete
+		actualContent, err := ioutil.ReadAll(r.Body)
+		if err == nil && bytes.Compare(expectedContent, actualContent) != 0 {
+			t.Errorf("%s: Expected content to be '%s', got '%s'", testName, string(expectedContent), string(actualContent))
+		}
+	}))
+}
+
+func collectResults(resultCh <-chan Result, n int) map[*http.Request]Result {
+	results := make(map[*http.Request]Result)
+	for ; n > 0; n-- {
+		result := <-resultCh
+		result.Close()
+		results[result.Request] = result
+	}
+	return results
+}
+
+func TestFanoutPipeWriter(t *testing.T) {
+	testName := "TestFanoutPipeWriter"
+
+	expectedContent := []byte("some content")
+	var reqs []*http.Request
+	for i := 0; i < 3; i++ {
+		svr := newFanoutServer(t, testName, expectedContent)
+		defer svr.Close()
+		req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+		reqs = append(reqs, req)
+	}
+
+	resultCh := make(chan Result)
+	w := FanoutPipeWriter(nil, reqs, FanoutPolicy{}, resultCh)
+	go func() {
+		w.Write(expectedContent[:4])
+		w.Write(expectedContent[4:])
+		w.Close()
+	}()
+
+	for i, result := range collectResults(resultCh, len(reqs)) {
+		if result.Error != nil {
+			t.Errorf("%s (1): Expected result.Error for %s to be nil, got %s", testName, i.URL, result.Error)
+		}
+	}
+}
+
+func TestFanoutPipeWriterFailedTarget(t *testing.T) {
+	testName := "TestFanoutPipeWriterFailedTarget"
+
+	expectedContent := []byte("some content")
+	tests := []struct {
+		mode             FanoutMode
+		expectWriteErr   bool
+		expectedFailures int
+	}{
+		{AbortAll, true, 2},
+		{DropFailed, false, 1},
+		{BufferLagging, false, 1},
+	}
+
+	for i, test := range tests {
+		svr := newFanoutServer(t, testName, expectedContent)
+		defer svr.Close()
+		dead := httptest.NewServer(http.NotFoundHandler())
+		dead.Close()
+
+		good, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+		bad, _ := http.NewRequest(http.MethodPost, dead.URL, nil)
+
+		resultCh := make(chan Result, 2)
+		w := FanoutPipeWriter(nil, []*http.Request{good, bad}, FanoutPolicy{Mode: test.mode}, resultCh)
+
+		// the failing request may not have failed by the time of the first write
+		var err error
+		for j := 0; j < 10 && err == nil; j++ {
+			time.Sleep(10 * time.Millisecond)
+			_, err = w.Write(expectedContent[j : j+1])
+		}
+		if test.expectWriteErr != (err != nil) {
+			t.Errorf("%s loop(%d) (1): Expected write error == %t, got %v", testName, i, test.expectWriteErr, err)
+		}
+		if err == nil {
+			w.Write(expectedContent[10:])
+		}
+		w.Close()
+
+		failures := 0
+		for _, result := range collectResults(resultCh, 2) {
+			if result.Error != nil {
+				failures++
+			}
+		}
+		if failures != test.expectedFailures {
+			t.Errorf("%s loop(%d) (2): Expected %d failed results, got %d", testName, i, test.expectedFailures, failures)
+		}
+	}
+}
+
+func TestFanoutPipeWriterLaggingTarget(t *testing.T) {
+	testName := "TestFanoutPipeWriterLaggingTarget"
+
+	expectedContent := bytes.Repeat([]byte("some content"), 100)
+	fast := newFanoutServer(t, testName, expectedContent)
+	defer fast.Close()
+	slow := newFanoutServer(t, testName, expectedContent)
+	defer slow.Close()
+
+	c := slowClient(slow.Listener.Addr().String(), 200*time.Millisecond)
+
+	tests := []struct {
+		mode           FanoutMode
+		slowFails      bool
+		expectWriteErr bool
+	}{
+		{BufferLagging, false, false},
+		{DropFailed, true, false},
+		{AbortAll, true, true},
+	}
+
+	for i, test := range tests {
+		fastReq, _ := http.NewRequest(http.MethodPost, fast.URL, nil)
+		slowReq, _ := http.NewRequest(http.MethodPost, slow.URL, nil)
+		resultCh := make(chan Result, 2)
+		policy := FanoutPolicy{Mode: test.mode, LagTimeout: 20 * time.Millisecond, Capacity: 64}
+		w := FanoutPipeWriter(c, []*http.Request{fastReq, slowReq}, policy, resultCh)
+
+		start := time.Now()
+		var err error
+		for j := 0; j < len(expectedContent) && err == nil; j += 100 {
+			_, err = w.Write(expectedContent[j : j+100])
+		}
+		w.Close()
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("%s loop(%d) (1): Expected writes not to be held up by the slow target, took %s", testName, i, elapsed)
+		}
+		if test.expectWriteErr != (err != nil) {
+			t.Errorf("%s loop(%d) (2): Expected write error == %t, got %v", testName, i, test.expectWriteErr, err)
+		}
+
+		results := collectResults(resultCh, 2)
+		if err := results[slowReq].Error; test.slowFails != (err != nil) {
+			t.Errorf("%s loop(%d) (3): Expected slow target error == %t, got %v", testName, i, test.slowFails, err)
+		}
+		if err := results[fastReq].Error; !test.expectWriteErr && err != nil {
+			t.Errorf("%s loop(%d) (4): Expected fast target error to be nil, got %s", testName, i, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// MultipartWriter streams a multipart/form-data request body. It is created by MultipartPipeWriter.
+type MultipartWriter struct {
+	pw  *io.PipeWriter
+	mw  *multipart.Writer
+	err error
+}
+
+// MultipartPipeWriter is like PipeWriter, except that the request body is written as multipart/form-data using the
+// returned MultipartWriter. The Content-Type header of req, including the boundary, is set accordingly. Callers must
+// call either Close or Abort when finished.
+func MultipartPipeWriter(c *http.Client, req *http.Request, resultCh chan<- Result) *MultipartWriter {
+	// the boundary has to be known before the request is started, which is before there's anything to write to
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+
+	m := &MultipartWriter{pw: pipeWriter(c, req, resultCh)}
+	m.mw = multipart.NewWriter(m.pw)
+	m.mw.SetBoundary(boundary)
+	return m
+}
+
+// WriteField writes a form field with the given name and value
+func (m *MultipartWriter) WriteField(name, value string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.err = m.mw.WriteField(name, value)
+	return m.err
+}
+
+// WriteFile writes a file part with the given field name and file name, whose content is read from r. If reading r
+// fails the request is aborted with the error returned by r.
+func (m *MultipartWriter) WriteFile(fieldname, filename string, r io.Reader) error {
+	if m.err != nil {
+		return m.err
+	}
+	w, err := m.mw.CreateFormFile(fieldname, filename)
+	if err != nil {
+		m.err = err
+		return err
+	}
+	return m.copy(w, r)
+}
+
+// WritePart writes a part with the given header, whose content is read from r. If reading r fails the request is
+// aborted with the error returned by r.
+func (m *MultipartWriter) WritePart(header textproto.MIMEHeader, r io.Reader) error {
+	if m.err != nil {
+		return m.err
+	}
+	w, err := m.mw.CreatePart(header)
+	if err != nil {
+		m.err = err
+		return err
+	}
+	return m.copy(w, r)
+}
+
+func (m *MultipartWriter) copy(w io.Writer, r io.Reader) error {
+	er := &errorRecordingReader{r: r}
+	if _, m.err = io.Copy(w, er); m.err != nil && er.err != nil {
+		m.Abort(er.err)
+	}
+	return m.err
+}
+
+// Close writes the closing boundary and then closes the request body
+func (m *MultipartWriter) Close() error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.err = m.mw.Close(); m.err != nil {
+		return m.err
+	}
+	m.err = io.ErrClosedPipe
+	return m.pw.Close()
+}
+
+// Abort aborts the request, which will fail with err
+func (m *MultipartWriter) Abort(err error) {
+	m.err = err
+	m.pw.CloseWithError(err)
+}
+
+// errorRecordingReader records the error returned by a reader so that it can be told apart from errors writing
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errorRecordingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMultipartPipeWriter(t *testing.T) {
+	testName := "TestMultipartPipeWriter"
+
+	content := strings.Repeat("some file content", 10000)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 10); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if expected, actual := "bar", r.FormValue("foo"); expected != actual {
+			t.Errorf("%s (1): Expected field foo to be '%s', got '%s'", testName, expected, actual)
+		}
+		f, fh, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("%s (2): Expected err to be nil, got %s", testName, err)
+			return
+		}
+		defer f.Close()
+		if expected, actual := "file.txt", fh.Filename; expected != actual {
+			t.Errorf("%s (3): Expected filename to be '%s', got '%s'", testName, expected, actual)
+		}
+		if actual, _ := ioutil.ReadAll(f); content != string(actual) {
+			t.Errorf("%s (4): Expected file content to be %d bytes, got %d", testName, len(content), len(actual))
+		}
+	}))
+	defer svr.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+	resultCh := make(chan Result, 1)
+	mw := MultipartPipeWriter(http.DefaultClient, req, resultCh)
+	if err := mw.WriteField("foo", "bar"); err != nil {
+		t.Fatalf("%s (5): Expected err to be nil, got %s", testName, err)
+	}
+	if err := mw.WriteFile("file", "file.txt", strings.NewReader(content)); err != nil {
+		t.Fatalf("%s (6): Expected err to be nil, got %s", testName, err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("%s (7): Expected err to be nil, got %s", testName, err)
+	}
+
+	result := <-resultCh
+	if result.Error != nil {
+		t.Fatalf("%s (8): Expected err to be nil, got %s", testName, result.Error)
+	}
+	defer result.Close()
+	if err := result.CheckStatus(); err != nil {
+		t.Errorf("%s (9): Expected err to be nil, got %s", testName, err)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestMultipartPipeWriterAbortsOnReaderError(t *testing.T) {
+	testName := "TestMultipartPipeWriterAbortsOnReaderError"
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer svr.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+	resultCh := make(chan Result, 1)
+	mw := MultipartPipeWriter(http.DefaultClient, req, resultCh)
+
+	readErr := errors.New("read failed")
+	if err := mw.WriteFile("file", "file.txt", errReader{readErr}); err != readErr {
+		t.Errorf("%s (1): Expected err to be '%s', got %v", testName, readErr, err)
+	}
+	if err := mw.Close(); err != readErr {
+		t.Errorf("%s (2): Expected Close to return '%s', got %v", testName, readErr, err)
+	}
+
+	result := <-resultCh
+	if result.Error == nil {
+		result.Close()
+		t.Fatalf("%s (3): Expected the request to fail", testName)
+	}
+	if !errors.Is(result.Error, readErr) {
+		t.Errorf("%s (4): Expected err to wrap '%s', got %s", testName, readErr, result.Error)
+	}
+}
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxStatusErrorBodySize is the maximum number of bytes of the response body that will be held by a StatusError
+const MaxStatusErrorBodySize = 512
+
+// maxDrainSize bounds the number of bytes that will be read and discarded when closing a response body. Bodies
+// that are larger than this are closed without being fully read, which means the underlying connection won't be reused.
+const maxDrainSize = 256 << 10
+
+// StatusError is returned by Result.CheckStatus when the response status code is not in the 2xx range. Body holds
+// at most MaxStatusErrorBodySize bytes from the beginning of the response body.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Body) == 0 {
+		return "unexpected response status: " + e.Status
+	}
+	return fmt.Sprintf("unexpected response status: %s: %q", e.Status, e.Body)
+}
+
+// Timings holds the points in time at which the various stages of executing a request were reached. Stages that
+// did not happen (e.g. DNS for a request made to an IP address or TLS for a reused connection) are left as the zero time.
+type Timings struct {
+	Start                               time.Time
+	DNSStart, DNSDone                   time.Time
+	ConnectStart, ConnectDone           time.Time
+	TLSHandshakeStart, TLSHandshakeDone time.Time
+	GotConn, WroteRequest, GotFirstByte time.Time
+	ConnReused                          bool
+}
+
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// DNS returns the time spent resolving the host name
+func (t Timings) DNS() time.Duration { return since(t.DNSStart, t.DNSDone) }
+
+// Connect returns the time spent establishing the TCP connection
+func (t Timings) Connect() time.Duration { return since(t.ConnectStart, t.ConnectDone) }
+
+// TLSHandshake returns the time spent performing the TLS handshake
+func (t Timings) TLSHandshake() time.Duration { return since(t.TLSHandshakeStart, t.TLSHandshakeDone) }
+
+// FirstByte returns the time from the start of the request until the first byte of the response was received
+func (t Timings) FirstByte() time.Duration { return since(t.Start, t.GotFirstByte) }
+
+// TraceTimings returns a shallow copy of req whose context records Timings via net/http/httptrace. The returned
+// function reports the timings recorded so far and may be called from any goroutine.
+func TraceTimings(req *http.Request) (*http.Request, func() Timings) {
+	var (
+		mu sync.Mutex
+		t  = Timings{Start: time.Now()}
+	)
+	record := func(f func()) {
+		mu.Lock()
+		f()
+		mu.Unlock()
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { record(func() { t.DNSStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { record(func() { t.DNSDone = time.Now() }) },
+		ConnectStart: func(string, string) {
+			record(func() {
+				if t.ConnectStart.IsZero() {
+					t.ConnectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			record(func() {
+				if err == nil && t.ConnectDone.IsZero() {
+					t.ConnectDone = time.Now()
+				}
+			})
+		},
+		TLSHandshakeStart: func() { record(func() { t.TLSHandshakeStart = time.Now() }) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { record(func() { t.TLSHandshakeDone = time.Now() }) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			record(func() {
+				t.GotConn = time.Now()
+				t.ConnReused = info.Reused
+			})
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { record(func() { t.WroteRequest = time.Now() }) },
+		GotFirstResponseByte: func() { record(func() { t.GotFirstByte = time.Now() }) },
+	}
+
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	return req.WithContext(ctx), func() Timings {
+		mu.Lock()
+		defer mu.Unlock()
+		return t
+	}
+}
+
+// CheckStatus returns r.Error if it is non-nil. Otherwise, if the response status code is not in the 2xx range, the
+// response body is closed and a *StatusError is returned.
+func (r Result) CheckStatus() error {
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.Response == nil {
+		return errors.New("result has no response")
+	}
+	if r.Response.StatusCode >= 200 && r.Response.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(r.Response.Body, MaxStatusErrorBodySize))
+	r.Close()
+	return &StatusError{StatusCode: r.Response.StatusCode, Status: r.Response.Status, Body: body}
+}
+
+// Decode checks the status of the result and then decodes the response body into v according to the response
+// Content-Type. JSON and XML content types are supported. The response body is always closed.
+func (r Result) Decode(v interface{}) error {
+	if err := r.CheckStatus(); err != nil {
+		return err
+	}
+
+	ct, _, _ := mime.ParseMediaType(r.Response.Header.Get("Content-Type"))
+	switch {
+	case ct == "application/json" || strings.HasSuffix(ct, "+json"):
+		return r.DecodeJSON(v)
+	case ct == "application/xml" || ct == "text/xml" || strings.HasSuffix(ct, "+xml"):
+		return r.DecodeXML(v)
+	}
+
+	r.Close()
+	return fmt.Errorf("cannot decode response with content type %q", ct)
+}
+
+// DecodeJSON checks the status of the result and then decodes the response body as JSON into v. The response body
+// is always closed.
+func (r Result) DecodeJSON(v interface{}) error {
+	if err := r.CheckStatus(); err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r.Response.Body).Decode(v)
+}
+
+// DecodeXML checks the status of the result and then decodes the response body as XML into v. The response body
+// is always closed.
+func (r Result) DecodeXML(v interface{}) error {
+	if err := r.CheckStatus(); err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(r.Response.Body).Decode(v)
+}
+
+// Close drains and closes the response body, if there is one, so that the underlying connection may be reused.
+// It is safe to call Close more than once.
+func (r Result) Close() error {
+	if r.Response == nil || r.Response.Body == nil {
+		return nil
+	}
+	io.Copy(io.Discard, io.LimitReader(r.Response.Body, maxDrainSize))
+	return r.Response.Body.Close()
+}
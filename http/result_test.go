@@ -0,0 +1,115 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, testName, url string) Result {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	traced, timings := TraceTimings(req)
+	res, err := http.DefaultClient.Do(traced)
+	if err != nil {
+		t.Fatalf("%s: unexpected error executing request: %s", testName, err)
+	}
+	return Result{Response: res, Request: req, Error: err, Timings: timings()}
+}
+
+func TestResultCheckStatus(t *testing.T) {
+	testName := "TestResultCheckStatus"
+
+	body := strings.Repeat("x", MaxStatusErrorBodySize*2)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			return
+		}
+		http.Error(w, body, http.StatusNotFound)
+	}))
+	defer svr.Close()
+
+	if err := get(t, testName, svr.URL+"/ok").CheckStatus(); err != nil {
+		t.Errorf("%s (1): expected err to be nil, got %s", testName, err)
+	}
+
+	err := get(t, testName, svr.URL+"/missing").CheckStatus()
+	se, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("%s (2): expected a *StatusError, got %T", testName, err)
+	}
+	if expected, actual := http.StatusNotFound, se.StatusCode; expected != actual {
+		t.Errorf("%s (3): expected status code to be %d, got %d", testName, expected, actual)
+	}
+	if expected, actual := []byte(body[:MaxStatusErrorBodySize]), se.Body; !bytes.Equal(expected, actual) {
+		t.Errorf("%s (4): expected body to be %d bytes of 'x', got '%s'", testName, MaxStatusErrorBodySize, actual)
+	}
+}
+
+func TestResultDecode(t *testing.T) {
+	testName := "TestResultDecode"
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"name":"foo"}`))
+		case "/xml":
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<value><name>bar</name></value>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("baz"))
+		}
+	}))
+	defer svr.Close()
+
+	type value struct {
+		Name string `json:"name" xml:"name"`
+	}
+
+	tests := []struct {
+		path, expected string
+		expectErr      bool
+	}{
+		{"/json", "foo", false},
+		{"/xml", "bar", false},
+		{"/text", "", true},
+	}
+
+	for i, test := range tests {
+		var v value
+		err := get(t, testName, svr.URL+test.path).Decode(&v)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s loop(%d) (1): expected error == %t, got %v", testName, i, test.expectErr, err)
+		}
+		if v.Name != test.expected {
+			t.Errorf("%s loop(%d) (2): expected name to be '%s', got '%s'", testName, i, test.expected, v.Name)
+		}
+	}
+}
+
+func TestPipeWriterRecordsTimings(t *testing.T) {
+	testName := "TestPipeWriterRecordsTimings"
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer svr.Close()
+
+	resultCh := make(chan Result)
+	req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+	w := PipeWriter(nil, req, resultCh)
+	w.Close()
+
+	result := <-resultCh
+	defer result.Close()
+	if result.Error != nil {
+		t.Fatalf("%s (1): expected result.Error to be nil, got %s", testName, result.Error)
+	}
+	if result.Timings.GotConn.IsZero() {
+		t.Errorf("%s (2): expected GotConn to be recorded", testName)
+	}
+	if result.Timings.FirstByte() <= 0 {
+		t.Errorf("%s (3): expected a positive time to first byte, got %s", testName, result.Timings.FirstByte())
+	}
+}
@@ -0,0 +1,528 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// Headers of the resumable upload protocol, which is the core protocol of tus.io (version 1.0.0) plus its creation
+// and termination extensions
+const (
+	TusResumableHeaderKey = "Tus-Resumable"
+	UploadOffsetHeaderKey = "Upload-Offset"
+	UploadLengthHeaderKey = "Upload-Length"
+	TusVersion            = "1.0.0"
+	// OffsetContentType is the content type of the body of a PATCH request
+	OffsetContentType = "application/offset+octet-stream"
+)
+
+const (
+	// DefaultUploadChunkSize is the size of the chunks in which an Uploader sends content when ChunkSize is zero
+	DefaultUploadChunkSize = 8 << 20
+	// DefaultUploadRetries is the number of consecutive times an Uploader retries a chunk when MaxRetries is zero
+	DefaultUploadRetries = 5
+	// DefaultUploadRetryDelay is the delay before an Uploader's first retry of a chunk when RetryDelay is zero
+	DefaultUploadRetryDelay = time.Second
+)
+
+// ResumableUploadHandler is the server side of the resumable upload protocol. An upload is created by a POST request
+// with an Upload-Length header to the path at which the handler is mounted, which responds with the upload's location.
+// Content is then appended to the upload by PATCH requests whose Upload-Offset header matches the upload's current
+// offset, which is reported in response to HEAD requests. An upload can be deleted with a DELETE request.
+//
+// Partial uploads are stored in Dir, so an upload can be resumed after the server restarts. Content that was received
+// before a PATCH request failed is kept. Once all of its content has been received an upload is moved to a file in
+// Dir named after its ID and OnComplete is called.
+type ResumableUploadHandler struct {
+	Dir string
+	// MaxSize, if greater than zero, is the largest Upload-Length that will be accepted
+	MaxSize int64
+	// OnComplete, if non-nil, is called with the ID and path of each upload once it is complete
+	OnComplete func(id, path string)
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func (h *ResumableUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(TusResumableHeaderKey, TusVersion)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if h.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		h.create(w, r)
+	case http.MethodHead:
+		h.head(w, r)
+	case http.MethodPatch:
+		h.patch(w, r)
+	case http.MethodDelete:
+		h.terminate(w, r)
+	default:
+		AllowedHandler(http.MethodOptions, http.MethodPost, http.MethodHead, http.MethodPatch, http.MethodDelete).ServeHTTP(w, r)
+	}
+}
+
+func (h *ResumableUploadHandler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(UploadLengthHeaderKey), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest)+": invalid "+UploadLengthHeaderKey, http.StatusBadRequest)
+		return
+	}
+	if h.MaxSize > 0 && length > h.MaxSize {
+		writeErr(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		writeErr(w, http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b[:])
+
+	if err := os.WriteFile(h.infoPath(id), []byte(strconv.FormatInt(length, 10)), 0600); err != nil {
+		writeErr(w, http.StatusInternalServerError)
+		return
+	}
+	f, err := os.OpenFile(h.partPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		os.Remove(h.infoPath(id))
+		writeErr(w, http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if length == 0 {
+		h.complete(id)
+	}
+
+	w.Header().Set("Location", path.Join(r.URL.Path, id))
+	w.Header().Set(UploadOffsetHeaderKey, "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *ResumableUploadHandler) head(w http.ResponseWriter, r *http.Request) {
+	id, ok := uploadID(r)
+	if !ok {
+		writeErr(w, http.StatusNotFound)
+		return
+	}
+	offset, length, err := h.state(id)
+	if err != nil {
+		writeStateErr(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(UploadOffsetHeaderKey, strconv.FormatInt(offset, 10))
+	w.Header().Set(UploadLengthHeaderKey, strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ResumableUploadHandler) patch(w http.ResponseWriter, r *http.Request) {
+	id, ok := uploadID(r)
+	if !ok {
+		writeErr(w, http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Content-Type") != OffsetContentType {
+		writeErr(w, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeaderKey), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest)+": invalid "+UploadOffsetHeaderKey, http.StatusBadRequest)
+		return
+	}
+
+	// a client that retries after a network failure may do so before its previous request has been abandoned here
+	if !h.lock(id) {
+		writeErr(w, http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	current, length, err := h.state(id)
+	if err != nil {
+		writeStateErr(w, err)
+		return
+	}
+	if offset != current {
+		w.Header().Set(UploadOffsetHeaderKey, strconv.FormatInt(current, 10))
+		writeErr(w, http.StatusConflict)
+		return
+	}
+	if current == length {
+		// the upload is complete, so a PATCH that repeats one whose response was lost succeeds, but one with more
+		// content is rejected. The upload may not have been completed if the server stopped after receiving it.
+		if _, err := os.Stat(h.partPath(id)); err == nil {
+			if err := h.complete(id); err != nil {
+				writeErr(w, http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set(UploadOffsetHeaderKey, strconv.FormatInt(current, 10))
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			writeErr(w, http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := os.OpenFile(h.partPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, length-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += n
+	w.Header().Set(UploadOffsetHeaderKey, strconv.FormatInt(offset, 10))
+
+	// the upload is complete once all of its content has been received, even if the request goes on to fail
+	if offset == length {
+		if err := h.complete(id); err != nil {
+			writeErr(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeErr(w, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		writeErr(w, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ResumableUploadHandler) terminate(w http.ResponseWriter, r *http.Request) {
+	id, ok := uploadID(r)
+	if !ok {
+		writeErr(w, http.StatusNotFound)
+		return
+	}
+	if !h.lock(id) {
+		writeErr(w, http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	if _, _, err := h.state(id); err != nil {
+		writeStateErr(w, err)
+		return
+	}
+	os.Remove(h.partPath(id))
+	os.Remove(filepath.Join(h.Dir, id))
+	os.Remove(h.infoPath(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ResumableUploadHandler) complete(id string) error {
+	p := filepath.Join(h.Dir, id)
+	if err := os.Rename(h.partPath(id), p); err != nil {
+		return err
+	}
+	if h.OnComplete != nil {
+		h.OnComplete(id, p)
+	}
+	return nil
+}
+
+// state returns the current offset and length of an upload
+func (h *ResumableUploadHandler) state(id string) (offset, length int64, err error) {
+	info, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return
+	}
+	if length, err = strconv.ParseInt(string(info), 10, 64); err != nil {
+		return
+	}
+
+	fi, err := os.Stat(h.partPath(id))
+	if os.IsNotExist(err) {
+		// the upload is complete
+		fi, err = os.Stat(filepath.Join(h.Dir, id))
+	}
+	if err != nil {
+		return
+	}
+	return fi.Size(), length, nil
+}
+
+func (h *ResumableUploadHandler) lock(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.active == nil {
+		h.active = make(map[string]bool)
+	}
+	if h.active[id] {
+		return false
+	}
+	h.active[id] = true
+	return true
+}
+
+func (h *ResumableUploadHandler) unlock(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.active, id)
+}
+
+func (h *ResumableUploadHandler) infoPath(id string) string {
+	return filepath.Join(h.Dir, id+".info")
+}
+
+func (h *ResumableUploadHandler) partPath(id string) string {
+	return filepath.Join(h.Dir, id+".part")
+}
+
+// uploadID returns the ID of the upload that a request refers to, which is the last element of its path. IDs are
+// validated so that they can't be used to refer to files outside of the upload directory.
+func uploadID(r *http.Request) (string, bool) {
+	id := path.Base(r.URL.Path)
+	if len(id) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+func writeStateErr(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		writeErr(w, http.StatusNotFound)
+		return
+	}
+	writeErr(w, http.StatusInternalServerError)
+}
+
+// Uploader is the client side of the resumable upload protocol implemented by ResumableUploadHandler. Content is sent
+// in chunks, each of which is buffered in an ioutil.OverflowBuffer while it is being sent. If sending a chunk fails,
+// the Uploader asks the server how much of it was received and sends the remainder, up to MaxRetries consecutive times.
+type Uploader struct {
+	// Client is used to send requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// ChunkSize is the maximum amount of content sent in a single PATCH request. If zero, DefaultUploadChunkSize is used.
+	ChunkSize int64
+	// MaxRetries is the number of consecutive failures after which an upload is abandoned. If zero,
+	// DefaultUploadRetries is used.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, which doubles with each consecutive failure. If zero,
+	// DefaultUploadRetryDelay is used.
+	RetryDelay time.Duration
+	// Capacity, Dir and Prefix configure the OverflowBuffers that chunks are buffered in
+	Capacity    int
+	Dir, Prefix string
+}
+
+// Upload creates an upload of size bytes at endpoint and sends the content read from r. The location of the upload is
+// returned, even if sending its content fails, so that it can be passed to Resume.
+func (u *Uploader) Upload(ctx context.Context, endpoint string, r io.Reader, size int64) (location string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(TusResumableHeaderKey, TusVersion)
+	req.Header.Set(UploadLengthHeaderKey, strconv.FormatInt(size, 10))
+
+	res, err := u.client().Do(req)
+	result := Result{Response: res, Request: req, Error: err}
+	defer result.Close()
+	if err = result.CheckStatus(); err != nil {
+		return "", err
+	}
+	loc, err := res.Location()
+	if err != nil {
+		return "", err
+	}
+	location = loc.String()
+	return location, u.send(ctx, location, r, 0, size)
+}
+
+// Resume continues the upload at location. The content is read from r starting at its beginning; the part of it that
+// the server has already received is skipped, by seeking if r is an io.Seeker.
+func (u *Uploader) Resume(ctx context.Context, location string, r io.Reader) error {
+	offset, size, err := u.head(ctx, location)
+	if err != nil {
+		return err
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, r, offset)
+	}
+	if err != nil {
+		return err
+	}
+	return u.send(ctx, location, r, offset, size)
+}
+
+func (u *Uploader) send(ctx context.Context, location string, r io.Reader, offset, size int64) error {
+	chunkSize := u.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultUploadChunkSize
+	}
+
+	for offset < size {
+		n := size - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+
+		ob := &ioutil.OverflowBuffer{Capacity: u.Capacity, Dir: u.Dir, Prefix: u.Prefix}
+		if _, err := io.CopyN(ob, r, n); err != nil {
+			ob.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		err := u.sendChunk(ctx, location, ob, offset, n)
+		ob.Close()
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// sendChunk sends the n bytes held by ob, which start at offset start of the upload
+func (u *Uploader) sendChunk(ctx context.Context, location string, ob *ioutil.OverflowBuffer, start, n int64) error {
+	maxRetries, delay := u.MaxRetries, u.RetryDelay
+	if maxRetries <= 0 {
+		maxRetries = DefaultUploadRetries
+	}
+	if delay <= 0 {
+		delay = DefaultUploadRetryDelay
+	}
+
+	offset, end := start, start+n
+	for failures := 0; offset < end; {
+		o, err := u.patch(ctx, location, io.NewSectionReader(ob, offset-start, end-offset), offset)
+		if err == nil {
+			if o > end {
+				return fmt.Errorf("upload offset %d is outside of the chunk being sent (%d-%d)", o, start, end)
+			}
+			if o > offset {
+				offset, failures = o, 0
+				continue
+			}
+			// a server that accepts nothing would otherwise be sent the same PATCH forever
+			err = fmt.Errorf("upload offset %d didn't advance from %d", o, offset)
+		}
+		if failures++; failures > maxRetries || !isResumable(ctx, err) {
+			return err
+		}
+
+		t := time.NewTimer(delay << (failures - 1))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+
+		// if asking for the offset fails, the next PATCH is sent at the same offset; should that be wrong it is
+		// rejected and the offset is asked for again
+		if o, _, err := u.head(ctx, location); err == nil {
+			if o < start || o > end {
+				return fmt.Errorf("upload offset %d is outside of the chunk being sent (%d-%d)", o, start, end)
+			}
+			offset = o
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) patch(ctx context.Context, location string, body io.Reader, offset int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(TusResumableHeaderKey, TusVersion)
+	req.Header.Set(UploadOffsetHeaderKey, strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", OffsetContentType)
+
+	resultCh := make(chan Result, 1)
+	w := PipeWriter(u.client(), req, resultCh)
+	// errors writing are the result of the request failing, which is reported by the result
+	io.Copy(w, body)
+	w.Close()
+
+	result := <-resultCh
+	defer result.Close()
+	if err := result.CheckStatus(); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(result.Response.Header.Get(UploadOffsetHeaderKey), 10, 64)
+}
+
+// head returns the current offset and length of the upload at location
+func (u *Uploader) head(ctx context.Context, location string) (offset, length int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, location, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(TusResumableHeaderKey, TusVersion)
+
+	res, err := u.client().Do(req)
+	result := Result{Response: res, Request: req, Error: err}
+	defer result.Close()
+	if err = result.CheckStatus(); err != nil {
+		return
+	}
+	if offset, err = strconv.ParseInt(res.Header.Get(UploadOffsetHeaderKey), 10, 64); err != nil {
+		return
+	}
+	length, err = strconv.ParseInt(res.Header.Get(UploadLengthHeaderKey), 10, 64)
+	return
+}
+
+func (u *Uploader) client() *http.Client {
+	if u.Client == nil {
+		return http.DefaultClient
+	}
+	return u.Client
+}
+
+// isResumable reports whether a failed PATCH request should be resumed
+func isResumable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *StatusError
+	if !errors.As(err, &se) {
+		// the request failed without a response
+		return true
+	}
+	switch se.StatusCode {
+	case http.StatusConflict, http.StatusLocked, http.StatusTooManyRequests:
+		return true
+	}
+	return se.StatusCode >= 500 && se.StatusCode != http.StatusNotImplemented
+}
@@ -0,0 +1,266 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rszewczyk/pkg/http/transport"
+)
+
+// failingReader returns err once n bytes have been read from r
+type failingReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, f.err
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func newResumableUploadServer(t *testing.T) (*httptest.Server, *ResumableUploadHandler, chan string) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := make(chan string, 1)
+	h := &ResumableUploadHandler{Dir: dir, OnComplete: func(id, path string) { completed <- path }}
+	svr := httptest.NewServer(h)
+	return svr, h, completed
+}
+
+func TestUploaderResumesAfterNetworkFailure(t *testing.T) {
+	testName := "TestUploaderResumesAfterNetworkFailure"
+
+	svr, h, completed := newResumableUploadServer(t)
+	defer os.RemoveAll(h.Dir)
+	defer svr.Close()
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	// every other PATCH request fails part of the way through its body
+	var mu sync.Mutex
+	patches := 0
+	c := &http.Client{Transport: transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == http.MethodPatch {
+			mu.Lock()
+			patches++
+			fail := patches%2 == 1
+			mu.Unlock()
+			if fail {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{&failingReader{r.Body, 5000, errors.New("network failure")}, r.Body}
+			}
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	dir, _ := ioutil.TempDir("", "chunks")
+	defer os.RemoveAll(dir)
+	u := &Uploader{Client: c, ChunkSize: 30000, RetryDelay: 10 * time.Millisecond, Capacity: 1000, Dir: dir}
+	location, err := u.Upload(context.Background(), svr.URL+"/files", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	if location == "" {
+		t.Errorf("%s (2): Expected a location", testName)
+	}
+
+	select {
+	case path := <-completed:
+		if actual, _ := ioutil.ReadFile(path); !bytes.Equal(content, actual) {
+			t.Errorf("%s (3): Expected the uploaded content to be the same, got %d bytes", testName, len(actual))
+		}
+	default:
+		t.Errorf("%s (4): Expected the upload to be complete", testName)
+	}
+	if patches < 8 {
+		t.Errorf("%s (5): Expected failed requests to be retried, got %d requests", testName, patches)
+	}
+}
+
+func TestUploaderResume(t *testing.T) {
+	testName := "TestUploaderResume"
+
+	svr, h, completed := newResumableUploadServer(t)
+	defer os.RemoveAll(h.Dir)
+	defer svr.Close()
+
+	content := bytes.Repeat([]byte("some content"), 10000)
+	u := &Uploader{ChunkSize: 25000}
+
+	// the source fails part of the way through the second chunk, which is not something that can be retried
+	readErr := errors.New("read failed")
+	location, err := u.Upload(context.Background(), svr.URL+"/files/", &failingReader{bytes.NewReader(content), 40000, readErr}, int64(len(content)))
+	if !errors.Is(err, readErr) {
+		t.Fatalf("%s (1): Expected err to be '%s', got %v", testName, readErr, err)
+	}
+
+	offset, length, err := u.head(context.Background(), location)
+	if err != nil {
+		t.Fatalf("%s (2): Expected err to be nil, got %s", testName, err)
+	}
+	if offset != 25000 || length != int64(len(content)) {
+		t.Errorf("%s (3): Expected offset and length to be 25000 and %d, got %d and %d", testName, len(content), offset, length)
+	}
+
+	// a PATCH at the wrong offset is rejected
+	if _, err := u.patch(context.Background(), location, bytes.NewReader(content), 0); err == nil {
+		t.Errorf("%s (4): Expected an error", testName)
+	} else if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusConflict {
+		t.Errorf("%s (5): Expected a 409 *StatusError, got %v", testName, err)
+	}
+
+	if err := u.Resume(context.Background(), location, bytes.NewReader(content)); err != nil {
+		t.Fatalf("%s (6): Expected err to be nil, got %s", testName, err)
+	}
+	if actual, _ := ioutil.ReadFile(<-completed); !bytes.Equal(content, actual) {
+		t.Errorf("%s (7): Expected the uploaded content to be the same, got %d bytes", testName, len(actual))
+	}
+}
+
+func TestUploaderNoProgress(t *testing.T) {
+	testName := "TestUploaderNoProgress"
+
+	svr, h, _ := newResumableUploadServer(t)
+	defer os.RemoveAll(h.Dir)
+	defer svr.Close()
+
+	// PATCH requests are answered without accepting anything
+	patches := 0
+	c := &http.Client{Transport: transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method != http.MethodPatch {
+			return http.DefaultTransport.RoundTrip(r)
+		}
+		patches++
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+		header := make(http.Header)
+		header.Set(UploadOffsetHeaderKey, r.Header.Get(UploadOffsetHeaderKey))
+		return &http.Response{StatusCode: http.StatusNoContent, Header: header, Body: http.NoBody, Request: r}, nil
+	})}
+
+	u := &Uploader{Client: c, MaxRetries: 2, RetryDelay: time.Millisecond}
+	_, err := u.Upload(context.Background(), svr.URL+"/files", bytes.NewReader([]byte("some content")), 12)
+	if err == nil {
+		t.Fatalf("%s (1): Expected the upload to fail", testName)
+	}
+	if expected := 3; patches != expected {
+		t.Errorf("%s (2): Expected %d requests, got %d", testName, expected, patches)
+	}
+}
+
+func TestResumableUploadHandlerPatchCompleted(t *testing.T) {
+	testName := "TestResumableUploadHandlerPatchCompleted"
+
+	svr, h, _ := newResumableUploadServer(t)
+	defer os.RemoveAll(h.Dir)
+	defer svr.Close()
+
+	content := []byte("some content")
+	location, err := (&Uploader{}).Upload(context.Background(), svr.URL+"/files", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+
+	for i, test := range []struct {
+		body           string
+		expectedStatus int
+	}{
+		{"", http.StatusNoContent},
+		{"more", http.StatusRequestEntityTooLarge},
+	} {
+		req, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader([]byte(test.body)))
+		req.Header.Set(TusResumableHeaderKey, TusVersion)
+		req.Header.Set(UploadOffsetHeaderKey, "12")
+		req.Header.Set("Content-Type", OffsetContentType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s loop(%d) (2): Expected err to be nil, got %s", testName, i, err)
+		}
+		res.Body.Close()
+		if test.expectedStatus != res.StatusCode {
+			t.Errorf("%s loop(%d) (3): Expected status code to be %d, got %d", testName, i, test.expectedStatus, res.StatusCode)
+		}
+		if expected, actual := "12", res.Header.Get(UploadOffsetHeaderKey); expected != actual {
+			t.Errorf("%s loop(%d) (4): Expected the final offset %s, got '%s'", testName, i, expected, actual)
+		}
+	}
+}
+
+func TestResumableUploadHandlerCompletes(t *testing.T) {
+	testName := "TestResumableUploadHandlerCompletes"
+
+	svr, h, completed := newResumableUploadServer(t)
+	defer os.RemoveAll(h.Dir)
+	defer svr.Close()
+
+	do := func(method, url string, header map[string]string, body string) *http.Response {
+		req, _ := http.NewRequest(method, url, bytes.NewReader([]byte(body)))
+		req.Header.Set(TusResumableHeaderKey, TusVersion)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+		}
+		res.Body.Close()
+		return res
+	}
+	content := "some content"
+
+	for i, test := range []struct {
+		// partial is written to the upload before a PATCH with offset and body
+		partial, offset, body string
+		expectedStatus        int
+	}{
+		// a PATCH with more content than remains completes the upload with what fits
+		{"", "0", content + " and more", http.StatusRequestEntityTooLarge},
+		// all the content was received, but the server stopped before completing the upload
+		{content, "12", "", http.StatusNoContent},
+	} {
+		res := do(http.MethodPost, svr.URL+"/files", map[string]string{UploadLengthHeaderKey: "12"}, "")
+		location := svr.URL + res.Header.Get("Location")
+		if test.partial != "" {
+			if err := os.WriteFile(h.partPath(path.Base(location)), []byte(test.partial), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		res = do(http.MethodPatch, location, map[string]string{UploadOffsetHeaderKey: test.offset, "Content-Type": OffsetContentType}, test.body)
+		if test.expectedStatus != res.StatusCode {
+			t.Errorf("%s loop(%d) (2): Expected status code to be %d, got %d", testName, i, test.expectedStatus, res.StatusCode)
+		}
+		select {
+		case p := <-completed:
+			if actual, _ := ioutil.ReadFile(p); string(actual) != content {
+				t.Errorf("%s loop(%d) (3): Expected the upload to hold '%s', got '%s'", testName, i, content, actual)
+			}
+		default:
+			t.Errorf("%s loop(%d) (4): Expected the upload to have been completed", testName, i)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// ServeOverflowBuffer replies to a request with the content of ob, using http.ServeContent. Range requests are
+// supported, including requests for multiple ranges, which are answered with a multipart/byteranges response, and
+// unsatisfiable ranges, which are answered with http.StatusRequestedRangeNotSatisfiable. If-Range, If-Match and
+// If-None-Match preconditions are checked against the ETag header of w, if it has been set, and the others against
+// modtime. The Content-Type is determined from the extension of name or, failing that, from the content itself.
+//
+// The content is read with ReadAt, so ob may be served to any number of requests at once, but must not be written to
+// in the meantime.
+func ServeOverflowBuffer(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, ob *ioutil.OverflowBuffer) {
+	http.ServeContent(w, r, name, modtime, io.NewSectionReader(ob, 0, ob.Size()))
+}
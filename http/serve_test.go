@@ -0,0 +1,84 @@
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pkgioutil "github.com/rszewczyk/pkg/ioutil"
+)
+
+func TestServeOverflowBuffer(t *testing.T) {
+	testName := "TestServeOverflowBuffer"
+
+	content := randomContent(10000)
+	ob := &pkgioutil.OverflowBuffer{Capacity: 1000}
+	ob.Write(content)
+	defer ob.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		ServeOverflowBuffer(w, r, "artifact.bin", time.Time{}, ob)
+	}))
+	defer svr.Close()
+
+	get := func(headers ...string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error executing request: %s", testName, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, body
+	}
+
+	res, body := get()
+	if http.StatusOK != res.StatusCode || !bytes.Equal(content, body) {
+		t.Errorf("%s (1): Expected status 200 with the full content, got %d with %d bytes", testName, res.StatusCode, len(body))
+	}
+
+	// a range that spans the memory and the spill file
+	res, body = get("Range", "bytes=900-1099")
+	if http.StatusPartialContent != res.StatusCode || !bytes.Equal(content[900:1100], body) {
+		t.Errorf("%s (2): Expected status 206 with bytes 900-1099, got %d with %d bytes", testName, res.StatusCode, len(body))
+	}
+
+	res, body = get("Range", "bytes=0-9,5000-5009")
+	mt, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if http.StatusPartialContent != res.StatusCode || mt != "multipart/byteranges" {
+		t.Fatalf("%s (3): Expected status 206 with multipart/byteranges, got %d with %s", testName, res.StatusCode, mt)
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for i, expected := range [][]byte{content[:10], content[5000:5010]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("%s (4): Expected err to be nil, got %s", testName, err)
+		}
+		if actual, _ := ioutil.ReadAll(part); !bytes.Equal(expected, actual) {
+			t.Errorf("%s (5): Expected part %d to hold the requested range", testName, i)
+		}
+	}
+
+	res, _ = get("Range", "bytes=20000-")
+	if expected, actual := http.StatusRequestedRangeNotSatisfiable, res.StatusCode; expected != actual {
+		t.Errorf("%s (6): Expected status code to be %d, got %d", testName, expected, actual)
+	}
+
+	res, body = get("Range", "bytes=100-199", "If-Range", `"v0"`)
+	if http.StatusOK != res.StatusCode || !bytes.Equal(content, body) {
+		t.Errorf("%s (7): Expected a stale If-Range to get the full content, got %d with %d bytes", testName, res.StatusCode, len(body))
+	}
+	res, body = get("Range", "bytes=100-199", "If-Range", `"v1"`)
+	if http.StatusPartialContent != res.StatusCode || !bytes.Equal(content[100:200], body) {
+		t.Errorf("%s (8): Expected a current If-Range to get the range, got %d with %d bytes", testName, res.StatusCode, len(body))
+	}
+}
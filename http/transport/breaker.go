@@ -0,0 +1,337 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultConsecutiveFailures is the number of consecutive failures that trips a Breaker when neither
+	// ConsecutiveFailures nor FailureRate is set
+	DefaultConsecutiveFailures = 5
+	// DefaultBreakerWindow is the sliding window over which Breaker computes the failure rate when Window is zero
+	DefaultBreakerWindow = 10 * time.Second
+	// DefaultOpenTimeout is the amount of time that a Breaker stays open when OpenTimeout is zero
+	DefaultOpenTimeout = 5 * time.Second
+
+	// breakerBuckets is the number of buckets that the sliding window is divided into
+	breakerBuckets = 10
+)
+
+// BreakerState is the state of the circuit for a single host
+type BreakerState int
+
+const (
+	// BreakerClosed is the state in which requests are allowed through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen is the state in which requests fail fast with an *OpenError
+	BreakerOpen
+	// BreakerHalfOpen is the state in which a limited number of trial requests are allowed through to decide whether
+	// the circuit should close again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// OpenError is the error returned by Breaker for requests to a host whose circuit is open. An http.Client will wrap
+// it in a *url.Error, from which it can be recovered using errors.As.
+type OpenError struct {
+	Host string
+	// Until is the time at which trial requests to Host will next be allowed
+	Until time.Time
+}
+
+func (e *OpenError) Error() string {
+	return "circuit breaker is open for " + e.Host
+}
+
+// Breaker is an http.RoundTripper that implements a circuit breaker for each host that requests are made to. A
+// host's circuit opens (trips) after too many consecutive failures or too high a failure rate. While a circuit is open,
+// requests fail immediately with an *OpenError. After OpenTimeout the circuit becomes half-open and a limited number of
+// trial requests are allowed through: if they all succeed the circuit closes, otherwise it opens again.
+type Breaker struct {
+	Transport http.RoundTripper
+	// ConsecutiveFailures is the number of consecutive failures that trips the breaker. If both ConsecutiveFailures
+	// and FailureRate are zero, DefaultConsecutiveFailures is used.
+	ConsecutiveFailures int
+	// FailureRate trips the breaker when the ratio of failures to requests within Window reaches it, provided that at
+	// least MinRequests were made. If Window is zero, DefaultBreakerWindow is used.
+	FailureRate float64
+	Window      time.Duration
+	MinRequests int
+	// OpenTimeout is how long the breaker stays open before allowing trial requests. If zero, DefaultOpenTimeout is used.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of trial requests that must succeed to close the breaker. If zero, 1 is used.
+	HalfOpenRequests int
+	// IsFailure reports whether the outcome of a request counts as a failure. If nil, errors and responses with a 5xx
+	// status count as failures. Requests that fail because their context was cancelled count as neither failures nor
+	// successes, so a cancelled trial request leaves the circuit half-open.
+	IsFailure func(*http.Response, error) bool
+	// OnStateChange, if non-nil, is called whenever the circuit for a host changes state. It is called synchronously
+	// from RoundTrip, but not while any locks are held.
+	OnStateChange func(host string, from, to BreakerState)
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type breakerBucket struct {
+	start              time.Time
+	requests, failures int
+}
+
+type circuit struct {
+	state       BreakerState
+	consecutive int
+	buckets     [breakerBuckets]breakerBucket
+	// epoch is when the circuit was created, from which the buckets are counted so that any clock can be used
+	epoch    time.Time
+	openedAt time.Time
+	// generation is incremented on every change of state so that requests that were allowed in one state are
+	// not counted in another
+	generation     int
+	trials, passed int
+}
+
+type stateChange struct {
+	host     string
+	from, to BreakerState
+}
+
+// Wrap sets next as the Transport of t and returns t. Wrap can be used as a middleware with Compose.
+func (t *Breaker) Wrap(next http.RoundTripper) http.RoundTripper {
+	t.Transport = next
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Breaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	generation, err := t.allow(host)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	res, err := roundTripper(t.Transport).RoundTrip(req)
+	if err != nil && errors.Is(err, context.Canceled) {
+		// the outcome of a cancelled request says nothing about the host
+		t.abandon(host, generation)
+		return res, err
+	}
+	t.record(host, generation, t.isFailure(res, err))
+	return res, err
+}
+
+// State returns the current state of the circuit for host
+func (t *Breaker) State(host string) BreakerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.circuits[host]; ok {
+		return c.state
+	}
+	return BreakerClosed
+}
+
+func (t *Breaker) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+func (t *Breaker) isFailure(res *http.Response, err error) bool {
+	if t.IsFailure != nil {
+		return t.IsFailure(res, err)
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode >= 500
+}
+
+func (t *Breaker) openTimeout() time.Duration {
+	if t.OpenTimeout == 0 {
+		return DefaultOpenTimeout
+	}
+	return t.OpenTimeout
+}
+
+func (t *Breaker) window() time.Duration {
+	if t.Window == 0 {
+		return DefaultBreakerWindow
+	}
+	return t.Window
+}
+
+func (t *Breaker) notify(changes []stateChange) {
+	if t.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		t.OnStateChange(c.host, c.from, c.to)
+	}
+}
+
+// transition changes the state of c, recording the change in changes
+func (t *Breaker) transition(host string, c *circuit, to BreakerState, changes []stateChange) []stateChange {
+	changes = append(changes, stateChange{host, c.state, to})
+	c.state = to
+	c.generation++
+	c.consecutive = 0
+	c.buckets = [breakerBuckets]breakerBucket{}
+	c.trials, c.passed = 0, 0
+	if to == BreakerOpen {
+		c.openedAt = t.now()
+	}
+	return changes
+}
+
+// allow returns the generation of the circuit for host if a request may be made to it
+func (t *Breaker) allow(host string) (generation int, err error) {
+	var changes []stateChange
+	defer func() { t.notify(changes) }()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.circuits == nil {
+		t.circuits = make(map[string]*circuit)
+	}
+	c, ok := t.circuits[host]
+	if !ok {
+		c = &circuit{epoch: t.now()}
+		t.circuits[host] = c
+	}
+
+	if c.state == BreakerOpen {
+		until := c.openedAt.Add(t.openTimeout())
+		if t.now().Before(until) {
+			return 0, &OpenError{Host: host, Until: until}
+		}
+		changes = t.transition(host, c, BreakerHalfOpen, changes)
+	}
+
+	if c.state == BreakerHalfOpen {
+		if c.trials >= t.halfOpenRequests() {
+			return 0, &OpenError{Host: host, Until: t.now()}
+		}
+		c.trials++
+	}
+	return c.generation, nil
+}
+
+func (t *Breaker) halfOpenRequests() int {
+	if t.HalfOpenRequests == 0 {
+		return 1
+	}
+	return t.HalfOpenRequests
+}
+
+func (t *Breaker) record(host string, generation int, failed bool) {
+	var changes []stateChange
+	defer func() { t.notify(changes) }()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.circuits[host]
+	if c.generation != generation {
+		return
+	}
+
+	switch c.state {
+	case BreakerHalfOpen:
+		if failed {
+			changes = t.transition(host, c, BreakerOpen, changes)
+			return
+		}
+		c.passed++
+		if c.passed >= t.halfOpenRequests() {
+			changes = t.transition(host, c, BreakerClosed, changes)
+		}
+	case BreakerClosed:
+		if t.tripped(c, failed) {
+			changes = t.transition(host, c, BreakerOpen, changes)
+		}
+	}
+}
+
+// abandon gives back the trial of a request that was allowed in generation but whose outcome isn't recorded
+func (t *Breaker) abandon(host string, generation int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.circuits[host]
+	if c.generation == generation && c.state == BreakerHalfOpen {
+		c.trials--
+	}
+}
+
+// tripped records the outcome of a request made while c was closed and reports whether c should open
+func (t *Breaker) tripped(c *circuit, failed bool) bool {
+	if failed {
+		c.consecutive++
+	} else {
+		c.consecutive = 0
+	}
+
+	consecutive := t.ConsecutiveFailures
+	if consecutive == 0 && t.FailureRate == 0 {
+		consecutive = DefaultConsecutiveFailures
+	}
+	if consecutive > 0 && c.consecutive >= consecutive {
+		return true
+	}
+	if t.FailureRate == 0 {
+		return false
+	}
+
+	now := t.now()
+	window := t.window()
+	width := int64(window / breakerBuckets)
+	if width < 1 {
+		width = 1
+	}
+	// the bucket index is rounded down and kept non-negative in case the clock goes back before the epoch
+	d := int64(now.Sub(c.epoch))
+	n := d / width
+	if d < 0 && d%width != 0 {
+		n--
+	}
+	start := c.epoch.Add(time.Duration(n * width))
+	b := &c.buckets[(n%breakerBuckets+breakerBuckets)%breakerBuckets]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	var requests, failures int
+	for _, b := range c.buckets {
+		if now.Sub(b.start) < window {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	return requests >= t.MinRequests && requests > 0 && float64(failures)/float64(requests) >= t.FailureRate
+}
@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statusServer responds with the status code held in status
+func statusServer() (*httptest.Server, *int32, *int32) {
+	status, received := new(int32), new(int32)
+	atomic.StoreInt32(status, http.StatusOK)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(received, 1)
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	})), status, received
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func doGet(c *http.Client, url string) error {
+	res, err := c.Get(url)
+	if err == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	testName := "TestBreakerConsecutiveFailures"
+
+	svr, status, received := statusServer()
+	defer svr.Close()
+	host := svr.Listener.Addr().String()
+
+	clock := &fakeClock{time.Now()}
+	var changes []BreakerState
+	b := &Breaker{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         time.Minute,
+		Now:                 clock.Now,
+		OnStateChange: func(h string, from, to BreakerState) {
+			if h != host {
+				t.Errorf("%s: Expected state change for %s, got %s", testName, host, h)
+			}
+			changes = append(changes, to)
+		},
+	}
+	c := &http.Client{Transport: b}
+
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		doGet(c, svr.URL)
+	}
+	if expected, actual := BreakerOpen, b.State(host); expected != actual {
+		t.Errorf("%s (1): Expected state to be %s, got %s", testName, expected, actual)
+	}
+
+	err := doGet(c, svr.URL)
+	var openErr *OpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("%s (2): Expected an *OpenError, got %v", testName, err)
+	}
+	if expected, actual := clock.now.Add(time.Minute), openErr.Until; !expected.Equal(actual) {
+		t.Errorf("%s (3): Expected the breaker to be open until %s, got %s", testName, expected, actual)
+	}
+	if expected, actual := int32(3), atomic.LoadInt32(received); expected != actual {
+		t.Errorf("%s (4): Expected the open breaker to fail fast, server received %d requests", testName, actual)
+	}
+
+	// a failed trial opens the breaker again and a successful one closes it
+	clock.now = clock.now.Add(time.Minute)
+	doGet(c, svr.URL)
+	if expected, actual := BreakerOpen, b.State(host); expected != actual {
+		t.Errorf("%s (5): Expected state to be %s, got %s", testName, expected, actual)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	atomic.StoreInt32(status, http.StatusOK)
+	if err := doGet(c, svr.URL); err != nil {
+		t.Errorf("%s (6): Expected err to be nil, got %s", testName, err)
+	}
+	if expected, actual := BreakerClosed, b.State(host); expected != actual {
+		t.Errorf("%s (7): Expected state to be %s, got %s", testName, expected, actual)
+	}
+
+	expectedChanges := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(expectedChanges) != len(changes) {
+		t.Fatalf("%s (8): Expected state changes %v, got %v", testName, expectedChanges, changes)
+	}
+	for i := range changes {
+		if expectedChanges[i] != changes[i] {
+			t.Errorf("%s (9): Expected state changes %v, got %v", testName, expectedChanges, changes)
+			break
+		}
+	}
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	testName := "TestBreakerFailureRate"
+
+	svr, status, _ := statusServer()
+	defer svr.Close()
+	host := svr.Listener.Addr().String()
+
+	clock := &fakeClock{time.Now()}
+	b := &Breaker{FailureRate: 0.5, MinRequests: 4, Window: 10 * time.Second, Now: clock.Now}
+	c := &http.Client{Transport: b}
+
+	// alternating failures never trip a consecutive failure count, but do reach a 50% failure rate
+	for i := 0; i < 3; i++ {
+		atomic.StoreInt32(status, int32(http.StatusOK+i%2*300))
+		doGet(c, svr.URL)
+	}
+	if expected, actual := BreakerClosed, b.State(host); expected != actual {
+		t.Errorf("%s (1): Expected state to be %s before MinRequests, got %s", testName, expected, actual)
+	}
+
+	// failures that have slid out of the window no longer count
+	clock.now = clock.now.Add(20 * time.Second)
+	atomic.StoreInt32(status, http.StatusOK)
+	doGet(c, svr.URL)
+	atomic.StoreInt32(status, http.StatusBadGateway)
+	for i := 0; i < 2; i++ {
+		doGet(c, svr.URL)
+	}
+	if expected, actual := BreakerClosed, b.State(host); expected != actual {
+		t.Errorf("%s (2): Expected state to be %s, got %s", testName, expected, actual)
+	}
+
+	doGet(c, svr.URL)
+	if expected, actual := BreakerOpen, b.State(host); expected != actual {
+		t.Errorf("%s (3): Expected state to be %s, got %s", testName, expected, actual)
+	}
+	if expected, actual := BreakerClosed, b.State("example.com"); expected != actual {
+		t.Errorf("%s (4): Expected other hosts to be unaffected, got %s", testName, actual)
+	}
+}
+
+func TestBreakerCancelledTrial(t *testing.T) {
+	testName := "TestBreakerCancelledTrial"
+
+	svr, status, _ := statusServer()
+	defer svr.Close()
+	host := svr.Listener.Addr().String()
+
+	clock := &fakeClock{time.Now()}
+	b := &Breaker{ConsecutiveFailures: 1, OpenTimeout: time.Minute, Now: clock.Now}
+	c := &http.Client{Transport: b}
+
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+	doGet(c, svr.URL)
+	clock.now = clock.now.Add(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL, nil)
+	if _, err := c.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("%s (1): Expected the trial to be cancelled, got %v", testName, err)
+	}
+	if expected, actual := BreakerHalfOpen, b.State(host); expected != actual {
+		t.Errorf("%s (2): Expected state to be %s after a cancelled trial, got %s", testName, expected, actual)
+	}
+
+	// the cancelled trial doesn't use up the trial request
+	atomic.StoreInt32(status, http.StatusOK)
+	if err := doGet(c, svr.URL); err != nil {
+		t.Errorf("%s (3): Expected err to be nil, got %s", testName, err)
+	}
+	if expected, actual := BreakerClosed, b.State(host); expected != actual {
+		t.Errorf("%s (4): Expected state to be %s, got %s", testName, expected, actual)
+	}
+}
+
+func TestBreakerTinyWindow(t *testing.T) {
+	testName := "TestBreakerTinyWindow"
+
+	svr, _, _ := statusServer()
+	defer svr.Close()
+
+	c := &http.Client{Transport: &Breaker{FailureRate: 0.5, Window: 5 * time.Nanosecond}}
+	if err := doGet(c, svr.URL); err != nil {
+		t.Errorf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+}
+
+func TestBreakerClock(t *testing.T) {
+	testName := "TestBreakerClock"
+
+	svr, status, _ := statusServer()
+	defer svr.Close()
+	host := svr.Listener.Addr().String()
+	atomic.StoreInt32(status, http.StatusBadGateway)
+
+	// the zero time is before 1970, and the clock may go back
+	clock := &fakeClock{}
+	b := &Breaker{FailureRate: 0.5, MinRequests: 3, Window: 10 * time.Second, Now: clock.Now}
+	c := &http.Client{Transport: b}
+	for _, step := range []time.Duration{0, -3 * time.Second, 4 * time.Second} {
+		clock.now = clock.now.Add(step)
+		doGet(c, svr.URL)
+	}
+	if expected, actual := BreakerOpen, b.State(host); expected != actual {
+		t.Errorf("%s (1): Expected state to be %s, got %s", testName, expected, actual)
+	}
+}
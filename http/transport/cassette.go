@@ -0,0 +1,500 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// CassetteFormat is the file format in which a Recorder stores interactions
+type CassetteFormat int
+
+const (
+	// FormatJSON is a simple JSON format
+	FormatJSON CassetteFormat = iota
+	// FormatHAR is the HTTP Archive format (version 1.2), which can be inspected using browser developer tools
+	FormatHAR
+)
+
+// jsonCassette is the FormatJSON representation of a cassette. In both formats bodies are stored base64 encoded,
+// since they may be binary.
+type jsonCassette struct {
+	Interactions []jsonInteraction `json:"interactions"`
+}
+
+type jsonInteraction struct {
+	Request struct {
+		Method     string      `json:"method"`
+		URL        string      `json:"url"`
+		Header     http.Header `json:"header"`
+		BodySHA256 string      `json:"body_sha256"`
+		Body       string      `json:"body"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		Body       string      `json:"body"`
+		Truncated  bool        `json:"truncated,omitempty"`
+	} `json:"response"`
+	Started  time.Time `json:"started"`
+	Duration int64     `json:"duration_ms"`
+}
+
+type harCassette struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            int64     `json:"time"`
+	Request         struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		Cookies     []harNameValue `json:"cookies"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		BodySHA256  string         `json:"_bodySHA256"`
+	} `json:"request"`
+	Response struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		Cookies     []harNameValue `json:"cookies"`
+		Content     struct {
+			Size     int64  `json:"size"`
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+		RedirectURL string `json:"redirectURL"`
+		HeadersSize int    `json:"headersSize"`
+		BodySize    int64  `json:"bodySize"`
+		Truncated   bool   `json:"_truncated,omitempty"`
+	} `json:"response"`
+	Cache   struct{} `json:"cache"`
+	Timings struct {
+		Send    int64 `json:"send"`
+		Wait    int64 `json:"wait"`
+		Receive int64 `json:"receive"`
+	} `json:"timings"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			nvs = append(nvs, harNameValue{name, v})
+		}
+	}
+	return nvs
+}
+
+func fromHARHeaders(nvs []harNameValue) http.Header {
+	h := make(http.Header)
+	for _, nv := range nvs {
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// writeCassette writes interactions to w in the given format. The cassette is first marshalled with a placeholder in
+// place of each body, and then the bodies are streamed from their OverflowBuffers into the output in place of the
+// placeholders so that they never need to be held in memory.
+func writeCassette(w io.Writer, format CassetteFormat, interactions []*Interaction) error {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	var bodies []recordedBody
+	placeholder := func(b recordedBody) string {
+		bodies = append(bodies, b)
+		return fmt.Sprintf("@@%x-%d@@", nonce, len(bodies)-1)
+	}
+
+	var v interface{}
+	switch format {
+	case FormatJSON:
+		v = toJSONCassette(interactions, placeholder)
+	case FormatHAR:
+		v = toHARCassette(interactions, placeholder)
+	default:
+		return fmt.Errorf("unknown cassette format %d", format)
+	}
+
+	meta, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	last := 0
+	re := regexp.MustCompile(fmt.Sprintf(`@@%x-(\d+)@@`, nonce))
+	for _, m := range re.FindAllSubmatchIndex(meta, -1) {
+		bw.Write(meta[last:m[0]])
+		last = m[1]
+
+		i, _ := strconv.Atoi(string(meta[m[2]:m[3]]))
+		enc := base64.NewEncoder(base64.StdEncoding, bw)
+		if _, err = io.Copy(enc, bodies[i].reader()); err != nil {
+			return err
+		}
+		enc.Close()
+	}
+	bw.Write(meta[last:])
+	return bw.Flush()
+}
+
+func toJSONCassette(interactions []*Interaction, placeholder func(recordedBody) string) *jsonCassette {
+	c := &jsonCassette{Interactions: []jsonInteraction{}}
+	for _, i := range interactions {
+		var ji jsonInteraction
+		ji.Request.Method = i.Method
+		ji.Request.URL = i.URL
+		ji.Request.Header = i.RequestHeader
+		ji.Request.BodySHA256 = i.RequestBodyHash
+		ji.Request.Body = placeholder(i.requestBody)
+		ji.Response.StatusCode = i.StatusCode
+		ji.Response.Header = i.ResponseHeader
+		ji.Response.Body = placeholder(i.responseBody)
+		ji.Response.Truncated = i.Truncated
+		ji.Started = i.Started
+		ji.Duration = int64(i.Duration / time.Millisecond)
+		c.Interactions = append(c.Interactions, ji)
+	}
+	return c
+}
+
+func toHARCassette(interactions []*Interaction, placeholder func(recordedBody) string) *harCassette {
+	c := new(harCassette)
+	c.Log.Version = "1.2"
+	c.Log.Creator.Name = "github.com/rszewczyk/pkg/http/transport"
+	c.Log.Creator.Version = "1.0"
+	c.Log.Entries = []harEntry{}
+
+	for _, i := range interactions {
+		var e harEntry
+		e.StartedDateTime = i.Started
+		e.Time = int64(i.Duration / time.Millisecond)
+		e.Timings.Wait = e.Time
+
+		e.Request.Method = i.Method
+		e.Request.URL = i.URL
+		e.Request.HTTPVersion = "HTTP/1.1"
+		e.Request.Headers = harHeaders(i.RequestHeader)
+		e.Request.QueryString = []harNameValue{}
+		e.Request.Cookies = []harNameValue{}
+		e.Request.HeadersSize = -1
+		e.Request.BodySize = i.requestBody.size
+		e.Request.BodySHA256 = i.RequestBodyHash
+		if i.requestBody.ob != nil {
+			e.Request.PostData = &harPostData{i.RequestHeader.Get("Content-Type"), placeholder(i.requestBody), "base64"}
+		}
+
+		e.Response.Status = i.StatusCode
+		e.Response.StatusText = http.StatusText(i.StatusCode)
+		e.Response.HTTPVersion = "HTTP/1.1"
+		e.Response.Headers = harHeaders(i.ResponseHeader)
+		e.Response.Cookies = []harNameValue{}
+		e.Response.Content.Size = i.responseBody.size
+		e.Response.Content.MimeType = i.ResponseHeader.Get("Content-Type")
+		e.Response.Content.Text = placeholder(i.responseBody)
+		e.Response.Truncated = i.Truncated
+		e.Response.Content.Encoding = "base64"
+		e.Response.HeadersSize = -1
+		e.Response.BodySize = i.responseBody.size
+
+		c.Log.Entries = append(c.Log.Entries, e)
+	}
+	return c
+}
+
+// readCassette reads interactions in the given format from r, decoding their bodies into OverflowBuffers. Like
+// writeCassette, it streams the bodies so that they never need to be held in memory: they are decoded into their
+// OverflowBuffers as r is read and replaced with placeholders in the rest of the cassette, which is then unmarshalled.
+func readCassette(r io.Reader, format CassetteFormat, capacity int, dir, prefix string) (interactions []*Interaction, err error) {
+	key := "body"
+	if format == FormatHAR {
+		key = "text"
+	} else if format != FormatJSON {
+		return nil, fmt.Errorf("unknown cassette format %d", format)
+	}
+
+	meta, bodies, err := extractBodies(r, key, func() *ioutil.OverflowBuffer {
+		return &ioutil.OverflowBuffer{Capacity: capacity, Dir: dir, Prefix: prefix}
+	})
+	used := make([]bool, len(bodies))
+	defer func() {
+		for i, b := range bodies {
+			if err != nil || !used[i] {
+				b.close()
+			}
+		}
+		if err != nil {
+			interactions = nil
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	body := func(s string) (recordedBody, error) {
+		if s == "" {
+			return recordedBody{}, nil
+		}
+		var i int
+		if _, err := fmt.Sscanf(s, "@@%d@@", &i); err != nil || i < 0 || i >= len(bodies) || used[i] {
+			return recordedBody{}, errors.New("invalid body")
+		}
+		used[i] = true
+		return bodies[i], nil
+	}
+
+	switch format {
+	case FormatJSON:
+		var c jsonCassette
+		if err = json.Unmarshal(meta, &c); err != nil {
+			return
+		}
+		for _, ji := range c.Interactions {
+			i := &Interaction{
+				Method:          ji.Request.Method,
+				URL:             ji.Request.URL,
+				RequestHeader:   ji.Request.Header,
+				RequestBodyHash: ji.Request.BodySHA256,
+				StatusCode:      ji.Response.StatusCode,
+				ResponseHeader:  ji.Response.Header,
+				Started:         ji.Started,
+				Duration:        time.Duration(ji.Duration) * time.Millisecond,
+				Truncated:       ji.Response.Truncated,
+			}
+			interactions = append(interactions, i)
+			if i.requestBody, err = body(ji.Request.Body); err != nil {
+				return
+			}
+			if i.responseBody, err = body(ji.Response.Body); err != nil {
+				return
+			}
+		}
+	case FormatHAR:
+		var c harCassette
+		if err = json.Unmarshal(meta, &c); err != nil {
+			return
+		}
+		for _, e := range c.Log.Entries {
+			i := &Interaction{
+				Method:          e.Request.Method,
+				URL:             e.Request.URL,
+				RequestHeader:   fromHARHeaders(e.Request.Headers),
+				RequestBodyHash: e.Request.BodySHA256,
+				StatusCode:      e.Response.Status,
+				ResponseHeader:  fromHARHeaders(e.Response.Headers),
+				Started:         e.StartedDateTime,
+				Duration:        time.Duration(e.Time) * time.Millisecond,
+				Truncated:       e.Response.Truncated,
+			}
+			interactions = append(interactions, i)
+			if e.Request.PostData != nil {
+				if i.requestBody, err = body(e.Request.PostData.Text); err != nil {
+					return
+				}
+			}
+			if i.responseBody, err = body(e.Response.Content.Text); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// extractBodies copies the JSON document read from r to meta, except for the non-empty string values of the given
+// key, which are base64 decoded into OverflowBuffers created by newBody and replaced with a placeholder holding
+// their index in bodies
+func extractBodies(r io.Reader, key string, newBody func() *ioutil.OverflowBuffer) (meta []byte, bodies []recordedBody, err error) {
+	defer func() {
+		if err != nil {
+			for _, b := range bodies {
+				b.close()
+			}
+			bodies = nil
+		}
+	}()
+
+	var (
+		br  = bufio.NewReader(r)
+		out bytes.Buffer
+		// prev is the last byte outside of a string that isn't whitespace, lastString holds the start of the last
+		// string and lastKey the start of the last key, which is enough to tell whether it is the given key
+		prev                byte
+		lastString, lastKey []byte
+	)
+	for {
+		c, rerr := br.ReadByte()
+		if rerr == io.EOF {
+			return out.Bytes(), bodies, nil
+		} else if rerr != nil {
+			return nil, nil, rerr
+		}
+
+		switch {
+		case c == '"' && prev == ':' && string(lastKey) == key:
+			var b recordedBody
+			if b, err = decodeBodyString(br, newBody); err != nil {
+				return
+			}
+			if b.ob == nil {
+				out.WriteString(`""`)
+			} else {
+				fmt.Fprintf(&out, `"@@%d@@"`, len(bodies))
+				bodies = append(bodies, b)
+			}
+			prev = '"'
+		case c == '"':
+			out.WriteByte(c)
+			lastString = lastString[:0]
+			if lastString, err = copyString(&out, br, lastString, len(key)+1); err != nil {
+				return
+			}
+			prev = '"'
+		case c == ':':
+			out.WriteByte(c)
+			lastKey = append(lastKey[:0], lastString...)
+			prev = c
+		default:
+			out.WriteByte(c)
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				prev = c
+			}
+		}
+	}
+}
+
+// copyString copies the rest of a JSON string, up to and including its closing quote, from br to out. Up to max bytes
+// of the string are appended to start.
+func copyString(out *bytes.Buffer, br *bufio.Reader, start []byte, max int) ([]byte, error) {
+	for escaped := false; ; {
+		c, err := br.ReadByte()
+		if err != nil {
+			return start, unexpectedEOF(err)
+		}
+		out.WriteByte(c)
+		if c == '"' && !escaped {
+			return start, nil
+		}
+		escaped = c == '\\' && !escaped
+		if len(start) < max {
+			start = append(start, c)
+		}
+	}
+}
+
+// decodeBodyString base64 decodes the rest of a JSON string from br into an OverflowBuffer created by newBody, which
+// is left out of the returned body if the string is empty
+func decodeBodyString(br *bufio.Reader, newBody func() *ioutil.OverflowBuffer) (recordedBody, error) {
+	ob := newBody()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	var n int64
+	go func() {
+		var err error
+		n, err = io.Copy(ob, base64.NewDecoder(base64.StdEncoding, pr))
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	err := unescapeString(bufio.NewWriter(pw), br)
+	pw.CloseWithError(err)
+	if derr := <-done; err == nil {
+		err = derr
+	}
+	if err != nil || n == 0 {
+		ob.Close()
+		return recordedBody{}, err
+	}
+	return recordedBody{ob, n}, nil
+}
+
+// unescapeString writes the rest of a JSON string from br to w, without its closing quote and with escape sequences
+// replaced by the characters that they stand for, and flushes w
+func unescapeString(w *bufio.Writer, br *bufio.Reader) error {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch c {
+		case '"':
+			return w.Flush()
+		case '\\':
+			if c, err = br.ReadByte(); err != nil {
+				return unexpectedEOF(err)
+			}
+			switch c {
+			case 'u':
+				var hex [4]byte
+				if _, err = io.ReadFull(br, hex[:]); err != nil {
+					return unexpectedEOF(err)
+				}
+				r, err := strconv.ParseUint(string(hex[:]), 16, 16)
+				if err != nil {
+					return err
+				}
+				w.WriteRune(rune(r))
+			case 'n':
+				w.WriteByte('\n')
+			case 'r':
+				w.WriteByte('\r')
+			case 't':
+				w.WriteByte('\t')
+			case 'b':
+				w.WriteByte('\b')
+			case 'f':
+				w.WriteByte('\f')
+			default:
+				w.WriteByte(c)
+			}
+		default:
+			w.WriteByte(c)
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+const (
+	// DefaultHedgePercentile is the latency percentile used by Hedge when neither Delay nor Percentile is set
+	DefaultHedgePercentile = 95
+	// DefaultHedgeBudget is the ratio of hedged requests to requests used by Hedge when Budget is zero
+	DefaultHedgeBudget = 0.05
+
+	// minLatencySamples is the number of latencies that must be observed before hedging by percentile
+	minLatencySamples = 20
+	// maxLatencySamples is the number of the most recent latencies that hedging by percentile is based on
+	maxLatencySamples = 256
+	// maxHedgeTokens bounds the number of hedges that can be sent in a burst after a quiet period
+	maxHedgeTokens = 10
+)
+
+// Hedge is an http.RoundTripper that reduces tail latency by sending a duplicate of an idempotent request when the
+// original has not produced a response within a delay. Whichever response arrives first is returned and the other
+// attempt is cancelled. Errors are not hedged: if an attempt fails before the hedge is sent, its error is returned.
+//
+// The number of hedges is bounded by a budget so that a slow backend doesn't receive twice the load. Request bodies
+// are captured once into an ioutil.OverflowBuffer and each attempt reads from it independently.
+type Hedge struct {
+	Transport http.RoundTripper
+	// Delay is how long to wait for a response before sending a hedge. If Delay is zero it is instead the
+	// Percentile'th percentile of recently observed latencies, and no hedges are sent until enough latencies have
+	// been observed. Only the latencies of original attempts are observed, since the latency of a hedge is shorter by
+	// the delay and would lower it over time. An original attempt that loses to its hedge is observed as the time at
+	// which it was cancelled, which is less than its latency but at least the delay, so it still counts above the
+	// percentile.
+	Delay time.Duration
+	// Percentile is used to determine the delay when Delay is zero. If zero, DefaultHedgePercentile is used.
+	Percentile float64
+	// Budget is the maximum ratio of hedges to requests, e.g. 0.1 allows one hedge for every ten requests. If zero,
+	// DefaultHedgeBudget is used. The budget starts with one hedge, so that the first requests can be hedged.
+	Budget float64
+	// Capacity, Dir and Prefix configure the OverflowBuffer that request bodies are captured into
+	Capacity    int
+	Dir, Prefix string
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	tokens    float64
+	seeded    bool
+}
+
+type hedgeAttempt struct {
+	res *http.Response
+	err error
+	i   int
+}
+
+// Wrap sets next as the Transport of t and returns t. Wrap can be used as a middleware with Compose.
+func (t *Hedge) Wrap(next http.RoundTripper) http.RoundTripper {
+	t.Transport = next
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Hedge) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := roundTripper(t.Transport)
+	if !isIdempotent(req) {
+		return rt.RoundTrip(req)
+	}
+
+	ob, size, err := captureBody(req, t.Capacity, t.Dir, t.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	body := &sharedBody{ob: ob, size: size, refs: 1}
+	defer body.release()
+
+	var (
+		attempts = make(chan hedgeAttempt, 2)
+		cancels  []context.CancelFunc
+	)
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		r := req.WithContext(ctx)
+		if ob != nil {
+			r.Body = body.reader()
+			r.GetBody = nil
+		}
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := rt.RoundTrip(r)
+			attempts <- hedgeAttempt{res, err, i}
+		}()
+	}
+
+	start := time.Now()
+	launch()
+	pending := 1
+	// originalFailed is set if the original attempt fails, after which it has no latency to observe
+	originalFailed := false
+
+	var hedge <-chan time.Time
+	if delay, ok := t.delay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			if t.spend() {
+				launch()
+				pending++
+			}
+		case a := <-attempts:
+			pending--
+			if a.err != nil {
+				cancels[a.i]()
+				originalFailed = originalFailed || a.i == 0
+				if pending > 0 {
+					continue
+				}
+				return nil, a.err
+			}
+
+			if !originalFailed {
+				t.observe(time.Since(start))
+			}
+			for i, cancel := range cancels {
+				if i != a.i {
+					cancel()
+				}
+			}
+			go discardAttempts(attempts, pending)
+			a.res.Body = &cancelOnClose{ReadCloser: a.res.Body, cancel: cancels[a.i]}
+			return a.res, nil
+		}
+	}
+}
+
+// discardAttempts closes any responses produced by the n cancelled attempts that will arrive on attempts
+func discardAttempts(attempts <-chan hedgeAttempt, n int) {
+	for ; n > 0; n-- {
+		if a := <-attempts; a.res != nil {
+			a.res.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose releases the context of the winning attempt once its response body has been closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// delay returns the amount of time to wait before hedging and whether or not a hedge may be sent at all. It also
+// credits the budget for the request that is about to be made.
+func (t *Hedge) delay() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	budget := t.Budget
+	if budget == 0 {
+		budget = DefaultHedgeBudget
+	}
+	if !t.seeded {
+		t.tokens, t.seeded = 1, true
+	}
+	t.tokens = math.Min(t.tokens+budget, maxHedgeTokens)
+
+	if t.Delay > 0 {
+		return t.Delay, true
+	}
+	if len(t.latencies) < minLatencySamples {
+		return 0, false
+	}
+
+	percentile := t.Percentile
+	if percentile == 0 {
+		percentile = DefaultHedgePercentile
+	}
+	sorted := append([]time.Duration(nil), t.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i], true
+}
+
+// spend takes a hedge from the budget, returning false if there is none to take
+func (t *Hedge) spend() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+func (t *Hedge) observe(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.latencies) < maxLatencySamples {
+		t.latencies = append(t.latencies, latency)
+		return
+	}
+	t.latencies[t.next] = latency
+	t.next = (t.next + 1) % maxLatencySamples
+}
+
+// sharedBody hands out independent readers of an OverflowBuffer and closes it once every reader, as well as the
+// initial reference, has been released
+type sharedBody struct {
+	mu   sync.Mutex
+	ob   *ioutil.OverflowBuffer
+	size int64
+	refs int
+}
+
+func (b *sharedBody) reader() io.ReadCloser {
+	b.mu.Lock()
+	b.refs++
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ioutil.CallbackReadCloser(io.NewSectionReader(b.ob, 0, b.size), func() error {
+		once.Do(b.release)
+		return nil
+	})
+}
+
+func (b *sharedBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs--
+	if b.refs == 0 && b.ob != nil {
+		b.ob.Close()
+	}
+}
@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hedgeServer echoes request bodies. Every other request, starting with the first, is held until it is cancelled or
+// a second has passed. The number of requests received and cancelled is recorded.
+func hedgeServer() (svr *httptest.Server, received, cancelled *int32) {
+	received, cancelled = new(int32), new(int32)
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(received, 1)%2 == 1 {
+			select {
+			case <-r.Context().Done():
+				atomic.AddInt32(cancelled, 1)
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write(body)
+	}))
+	return
+}
+
+func TestHedge(t *testing.T) {
+	testName := "TestHedge"
+
+	svr, received, cancelled := hedgeServer()
+	defer svr.Close()
+
+	expectedContent := []byte(strings.Repeat("some content", 100))
+	c := &http.Client{Transport: &Hedge{Delay: 20 * time.Millisecond, Budget: 1, Capacity: 100}}
+	req, _ := http.NewRequest(http.MethodPut, svr.URL, bytes.NewReader(expectedContent))
+
+	start := time.Now()
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	actualContent, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("%s (2): Expected the hedged response, took %s", testName, elapsed)
+	}
+	if !bytes.Equal(expectedContent, actualContent) {
+		t.Errorf("%s (3): Expected the request body to be sent with the hedge, got '%s'", testName, actualContent)
+	}
+	if expected, actual := int32(2), atomic.LoadInt32(received); expected != actual {
+		t.Errorf("%s (4): Expected %d requests, got %d", testName, expected, actual)
+	}
+
+	// give the server a moment to notice the cancellation
+	time.Sleep(50 * time.Millisecond)
+	if expected, actual := int32(1), atomic.LoadInt32(cancelled); expected != actual {
+		t.Errorf("%s (5): Expected %d cancelled request, got %d", testName, expected, actual)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	testName := "TestHedgeBudget"
+
+	received := new(int32)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(received, 1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer svr.Close()
+
+	c := &http.Client{Transport: &Hedge{Delay: 5 * time.Millisecond, Budget: 0.5}}
+	for i := 0; i < 4; i++ {
+		res, err := c.Get(svr.URL)
+		if err != nil {
+			t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+		}
+		res.Body.Close()
+	}
+
+	// give the server a moment to receive any hedges that lost
+	time.Sleep(20 * time.Millisecond)
+	// the budget starts with one hedge and is credited with half a hedge per request, so the first, second and
+	// fourth requests are hedged
+	if expected, actual := int32(7), atomic.LoadInt32(received); expected != actual {
+		t.Errorf("%s (2): Expected %d requests, got %d", testName, expected, actual)
+	}
+}
+
+func TestHedgePercentile(t *testing.T) {
+	testName := "TestHedgePercentile"
+
+	svr, received, _ := hedgeServer()
+	defer svr.Close()
+
+	h := &Hedge{Percentile: 50, Budget: 1}
+	for i := 0; i < minLatencySamples; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+	c := &http.Client{Transport: h}
+
+	start := time.Now()
+	res, err := c.Get(svr.URL)
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("%s (2): Expected the hedged response, took %s", testName, elapsed)
+	}
+	if expected, actual := int32(2), atomic.LoadInt32(received); expected != actual {
+		t.Errorf("%s (3): Expected %d requests, got %d", testName, expected, actual)
+	}
+}
+
+func TestHedgeObservesOriginalAttempts(t *testing.T) {
+	testName := "TestHedgeObservesOriginalAttempts"
+
+	// only the first request is held, so the first request is answered by its hedge and the second by its original
+	// attempt. The original attempt of the third request fails after its hedge has been sent, before the hedge answers.
+	received := new(int32)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(received, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}))
+	defer svr.Close()
+
+	attempts := new(int32)
+	h := &Hedge{Delay: 20 * time.Millisecond, Budget: 1, Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		switch atomic.AddInt32(attempts, 1) {
+		case 4:
+			time.Sleep(30 * time.Millisecond)
+			return nil, errors.New("original attempt failed")
+		case 5:
+			time.Sleep(30 * time.Millisecond)
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	c := &http.Client{Transport: h}
+	for i := 0; i < 3; i++ {
+		res, err := c.Get(svr.URL)
+		if err != nil {
+			t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+		}
+		res.Body.Close()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the original attempt that lost to its hedge is observed as the time at which it was cancelled
+	if expected, actual := 2, len(h.latencies); expected != actual {
+		t.Fatalf("%s (2): Expected %d latencies to be observed, got %d", testName, expected, actual)
+	}
+	if h.latencies[0] < h.Delay {
+		t.Errorf("%s (3): Expected the cancelled attempt to be observed as at least %s, got %s", testName, h.Delay, h.latencies[0])
+	}
+}
+
+func TestHedgeNotIdempotent(t *testing.T) {
+	testName := "TestHedgeNotIdempotent"
+
+	svr, received, _ := hedgeServer()
+	defer svr.Close()
+
+	c := &http.Client{Transport: &Hedge{Delay: time.Millisecond, Budget: 1}}
+	res, err := c.Post(svr.URL, "text/plain", strings.NewReader("some content"))
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if expected, actual := int32(1), atomic.LoadInt32(received); expected != actual {
+		t.Errorf("%s (2): Expected %d request, got %d", testName, expected, actual)
+	}
+}
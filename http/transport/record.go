@@ -0,0 +1,433 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+// RecorderMode determines whether a Recorder records exchanges or replays them
+type RecorderMode int
+
+const (
+	// ModeRecord sends requests using the Recorder's Transport and records the exchanges
+	ModeRecord RecorderMode = iota
+	// ModeReplay responds to requests with previously recorded exchanges without using the network
+	ModeReplay
+)
+
+// RedactedValue replaces the values of redacted headers and query parameters in recorded interactions
+const RedactedValue = "REDACTED"
+
+// DefaultRedactHeaders are the headers that a Recorder redacts when RedactHeaders is nil
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// ErrNoInteraction is returned by a replaying Recorder when no recorded interaction matches a request
+var ErrNoInteraction = errors.New("no recorded interaction matches the request")
+
+// Interaction is a single recorded exchange. Header values and query parameters are stored as redacted.
+type Interaction struct {
+	Method          string
+	URL             string
+	RequestHeader   http.Header
+	RequestBodyHash string
+	StatusCode      int
+	ResponseHeader  http.Header
+	Started         time.Time
+	Duration        time.Duration
+	// Truncated is true if the response body was closed before it had been read to the end and the remainder was
+	// too large to be read, so that only part of it was recorded
+	Truncated bool
+
+	requestBody, responseBody recordedBody
+	replayed                  bool
+}
+
+// recordedBody is the body of a recorded request or response. The content is held in an OverflowBuffer whether it
+// was recorded or loaded from a cassette, which is read using ReadAt so that it can be replayed any number of times.
+type recordedBody struct {
+	ob   *ioutil.OverflowBuffer
+	size int64
+}
+
+func (b recordedBody) reader() io.Reader {
+	if b.ob == nil {
+		return eofReader{}
+	}
+	return io.NewSectionReader(b.ob, 0, b.size)
+}
+
+func (b recordedBody) close() {
+	if b.ob != nil {
+		b.ob.Close()
+	}
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// Matcher reports whether a recorded interaction matches a request that is to be replayed. The request is given in
+// the form of an Interaction that has only its request fields set, redacted in the same way as recorded interactions.
+type Matcher func(req, recorded *Interaction) bool
+
+// MatchMethod matches interactions with the same request method
+func MatchMethod(req, recorded *Interaction) bool {
+	return req.Method == recorded.Method
+}
+
+// MatchURL matches interactions with the same request URL
+func MatchURL(req, recorded *Interaction) bool {
+	return req.URL == recorded.URL
+}
+
+// MatchBody matches interactions whose request bodies have the same SHA-256 hash
+func MatchBody(req, recorded *Interaction) bool {
+	return req.RequestBodyHash == recorded.RequestBodyHash
+}
+
+// MatchHeaders returns a Matcher that matches interactions whose requests have the same values for each of names
+func MatchHeaders(names ...string) Matcher {
+	return func(req, recorded *Interaction) bool {
+		for _, name := range names {
+			if !stringSlicesAreEqual(req.RequestHeader[http.CanonicalHeaderKey(name)], recorded.RequestHeader[http.CanonicalHeaderKey(name)]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Recorder is an http.RoundTripper that records exchanges to a cassette file and replays them later, which allows
+// tests that make HTTP requests to run deterministically and without a network.
+//
+// When recording, request and response bodies are streamed through ioutil.OverflowBuffers, so large payloads are
+// spilled to disk rather than held in memory. An exchange is recorded once its response body has been read to the end
+// or closed. Recorded interactions are written to the cassette by Save or Close.
+//
+// When replaying, the cassette is loaded on the first request. Each request is answered with the first interaction
+// that satisfies every matcher and hasn't already been replayed; if they all have been, the last match is used again.
+type Recorder struct {
+	Transport http.RoundTripper
+	Mode      RecorderMode
+	// Path is the location of the cassette file and Format is its format
+	Path   string
+	Format CassetteFormat
+	// Matchers determine which recorded interaction is replayed for a request. If nil, MatchMethod and MatchURL are used.
+	Matchers []Matcher
+	// RedactHeaders are the names of headers, in both requests and responses, whose values are replaced with
+	// RedactedValue when recorded. If nil, DefaultRedactHeaders is used.
+	RedactHeaders []string
+	// RedactQuery are the names of query parameters whose values are replaced with RedactedValue when recorded
+	RedactQuery []string
+	// Capacity, Dir and Prefix configure the OverflowBuffers that bodies are held in
+	Capacity    int
+	Dir, Prefix string
+
+	mu           sync.Mutex
+	loaded       bool
+	interactions []*Interaction
+}
+
+// Wrap sets next as the Transport of t and returns t. Wrap can be used as a middleware with Compose.
+func (t *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	t.Transport = next
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, hash, err := t.captureBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Interaction{
+		Method:          req.Method,
+		URL:             t.redactURL(req.URL),
+		RequestHeader:   t.redactHeader(req.Header),
+		RequestBodyHash: hash,
+		Started:         time.Now(),
+		requestBody:     body,
+	}
+
+	if t.Mode == ModeReplay {
+		body.close()
+		return t.replay(req, i)
+	}
+	return t.record(req, i)
+}
+
+func (t *Recorder) captureBody(req *http.Request) (recordedBody, string, error) {
+	h := sha256.New()
+	if req.Body == nil || req.Body == http.NoBody {
+		return recordedBody{}, hex.EncodeToString(h.Sum(nil)), nil
+	}
+	defer req.Body.Close()
+
+	ob := &ioutil.OverflowBuffer{Capacity: t.Capacity, Dir: t.Dir, Prefix: t.Prefix}
+	n, err := io.Copy(io.MultiWriter(ob, h), req.Body)
+	if err != nil {
+		ob.Close()
+		return recordedBody{}, "", err
+	}
+	return recordedBody{ob, n}, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (t *Recorder) record(req *http.Request, i *Interaction) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	if i.requestBody.ob != nil {
+		r.Body = io.NopCloser(i.requestBody.reader())
+		r.GetBody = nil
+	}
+
+	res, err := roundTripper(t.Transport).RoundTrip(r)
+	if err != nil {
+		i.requestBody.close()
+		return nil, err
+	}
+
+	i.StatusCode = res.StatusCode
+	i.ResponseHeader = t.redactHeader(res.Header)
+	res.Body = &recordingBody{
+		ReadCloser: res.Body,
+		ob:         &ioutil.OverflowBuffer{Capacity: t.Capacity, Dir: t.Dir, Prefix: t.Prefix},
+		done: func(body recordedBody, truncated bool, err error) {
+			if err != nil {
+				i.requestBody.close()
+				body.close()
+				return
+			}
+			i.Duration = time.Since(i.Started)
+			i.responseBody = body
+			i.Truncated = truncated
+			t.mu.Lock()
+			t.interactions = append(t.interactions, i)
+			t.mu.Unlock()
+		},
+	}
+	return res, nil
+}
+
+// recordingBody copies a response body into an OverflowBuffer as it is read. If the body is closed before it has been
+// read to the end, up to maxDrainSize bytes of the remainder are read so that the recording is complete; if there is
+// more, as with a stream, the recording is truncated.
+type recordingBody struct {
+	io.ReadCloser
+	ob   *ioutil.OverflowBuffer
+	size int64
+	eof  bool
+	done func(body recordedBody, truncated bool, err error)
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := b.ob.Write(p[:n]); werr != nil {
+			b.finish(werr)
+		}
+		b.size += int64(n)
+	}
+	switch {
+	case err == io.EOF:
+		b.eof = true
+		b.finish(nil)
+	case err != nil:
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	if _, err := io.Copy(io.Discard, io.LimitReader(b, maxDrainSize)); err != nil || b.eof {
+		b.finish(err)
+	} else {
+		b.finishTruncated()
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) finish(err error) {
+	b.once.Do(func() {
+		b.done(recordedBody{b.ob, b.size}, false, err)
+	})
+}
+
+func (b *recordingBody) finishTruncated() {
+	b.once.Do(func() {
+		b.done(recordedBody{b.ob, b.size}, true, nil)
+	})
+}
+
+func (t *Recorder) replay(req *http.Request, i *Interaction) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.loaded {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	matchers := t.Matchers
+	if matchers == nil {
+		matchers = []Matcher{MatchMethod, MatchURL}
+	}
+
+	var match *Interaction
+	for _, recorded := range t.interactions {
+		if !matches(matchers, i, recorded) {
+			continue
+		}
+		match = recorded
+		if !recorded.replayed {
+			break
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, i.Method, i.URL)
+	}
+	match.replayed = true
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", match.StatusCode, http.StatusText(match.StatusCode)),
+		StatusCode:    match.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        match.ResponseHeader.Clone(),
+		Body:          io.NopCloser(match.responseBody.reader()),
+		ContentLength: match.responseBody.size,
+		Request:       req,
+	}, nil
+}
+
+func matches(matchers []Matcher, req, recorded *Interaction) bool {
+	for _, m := range matchers {
+		if !m(req, recorded) {
+			return false
+		}
+	}
+	return true
+}
+
+// load reads the cassette. It must be called with t.mu held.
+func (t *Recorder) load() error {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	interactions, err := readCassette(f, t.Format, t.Capacity, t.Dir, t.Prefix)
+	if err != nil {
+		return fmt.Errorf("reading cassette %s: %w", t.Path, err)
+	}
+	t.interactions = interactions
+	t.loaded = true
+	return nil
+}
+
+// Save writes the interactions recorded so far to the cassette file
+func (t *Recorder) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, err := os.Create(t.Path)
+	if err != nil {
+		return err
+	}
+	if err = writeCassette(f, t.Format, t.interactions); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close saves the cassette when recording and then releases the buffers that hold interaction bodies
+func (t *Recorder) Close() (err error) {
+	if t.Mode == ModeRecord {
+		err = t.Save()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, i := range t.interactions {
+		i.requestBody.close()
+		i.responseBody.close()
+	}
+	t.interactions = nil
+	t.loaded = false
+	return
+}
+
+// Interactions returns the interactions that have been recorded or loaded
+func (t *Recorder) Interactions() []*Interaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Interaction(nil), t.interactions...)
+}
+
+func (t *Recorder) redactHeaders() []string {
+	if t.RedactHeaders == nil {
+		return DefaultRedactHeaders
+	}
+	return t.RedactHeaders
+}
+
+func (t *Recorder) redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range t.redactHeaders() {
+		values := h[http.CanonicalHeaderKey(name)]
+		for i := range values {
+			values[i] = RedactedValue
+		}
+	}
+	return h
+}
+
+func (t *Recorder) redactURL(u *url.URL) string {
+	if len(t.RedactQuery) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+
+	q := u.Query()
+	redacted := false
+	for _, name := range t.RedactQuery {
+		values := q[name]
+		for i := range values {
+			values[i] = RedactedValue
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+func stringSlicesAreEqual(first, second []string) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	for i, s := range first {
+		if second[i] != s {
+			return false
+		}
+	}
+	return true
+}
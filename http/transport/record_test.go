@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	testName := "TestRecorder"
+
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	largeContent := []byte(strings.Repeat("some content", 1000))
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		switch r.URL.Path {
+		case "/large":
+			w.Write(largeContent)
+		case "/echo":
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("short and stout"))
+		}
+	}))
+	defer svr.Close()
+
+	// replays must not use the network
+	noNetwork := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("%s: Expected replayed requests not to be sent", testName)
+		return nil, errors.New("unexpected request")
+	})
+
+	for i, format := range []CassetteFormat{FormatJSON, FormatHAR} {
+		path := filepath.Join(dir, fmt.Sprintf("cassette-%d", i))
+		matchers := []Matcher{MatchMethod, MatchURL, MatchBody}
+
+		rec := &Recorder{Path: path, Format: format, Matchers: matchers, RedactQuery: []string{"key"}, Capacity: 100}
+		requests := func(c *http.Client) (contents [][]byte, statuses []int) {
+			for _, r := range []struct {
+				method, path, body string
+			}{
+				{http.MethodGet, "/large?key=secret", ""},
+				{http.MethodPost, "/echo", "first"},
+				{http.MethodPost, "/echo", "second"},
+				{http.MethodGet, "/teapot", ""},
+			} {
+				req, _ := http.NewRequest(r.method, svr.URL+r.path, strings.NewReader(r.body))
+				req.Header.Set("Authorization", "Bearer secret")
+				res, err := c.Do(req)
+				if err != nil {
+					t.Fatalf("%s loop(%d) (1): Expected err to be nil, got %s", testName, i, err)
+				}
+				content, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				contents = append(contents, content)
+				statuses = append(statuses, res.StatusCode)
+			}
+			return
+		}
+
+		expectedContents, expectedStatuses := requests(&http.Client{Transport: rec})
+		if err := rec.Close(); err != nil {
+			t.Fatalf("%s loop(%d) (2): Expected err to be nil, got %s", testName, i, err)
+		}
+
+		cassette, _ := ioutil.ReadFile(path)
+		if bytes.Contains(cassette, []byte("secret")) {
+			t.Errorf("%s loop(%d) (3): Expected secrets to be redacted, got %s", testName, i, cassette)
+		}
+
+		rec = &Recorder{Transport: noNetwork, Path: path, Format: format, Mode: ModeReplay, Matchers: matchers, RedactQuery: []string{"key"}}
+		defer rec.Close()
+		actualContents, actualStatuses := requests(&http.Client{Transport: rec})
+		for j := range expectedContents {
+			if !bytes.Equal(expectedContents[j], actualContents[j]) {
+				t.Errorf("%s loop(%d) (4): Expected replayed content of request %d to be '%s', got '%s'", testName, i, j, expectedContents[j], actualContents[j])
+			}
+			if expectedStatuses[j] != actualStatuses[j] {
+				t.Errorf("%s loop(%d) (5): Expected replayed status of request %d to be %d, got %d", testName, i, j, expectedStatuses[j], actualStatuses[j])
+			}
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, svr.URL+"/echo", strings.NewReader("third"))
+		if _, err := rec.RoundTrip(req); !errors.Is(err, ErrNoInteraction) {
+			t.Errorf("%s loop(%d) (6): Expected ErrNoInteraction, got %v", testName, i, err)
+		}
+	}
+}
+
+func TestRecorderClosedEarly(t *testing.T) {
+	testName := "TestRecorderClosedEarly"
+
+	// the stream only ends when the request is cancelled, so draining it to the end would never finish
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 1024))
+		if r.URL.Path == "/short" {
+			w.Write(chunk)
+			return
+		}
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer svr.Close()
+
+	rec := &Recorder{Path: filepath.Join(t.TempDir(), "cassette"), Capacity: 1000}
+	defer rec.Close()
+	c := &http.Client{Transport: rec}
+
+	for i, path := range []string{"/short", "/stream"} {
+		res, err := c.Get(svr.URL + path)
+		if err != nil {
+			t.Fatalf("%s loop(%d) (1): Expected err to be nil, got %s", testName, i, err)
+		}
+		res.Body.Read(make([]byte, 10))
+
+		done := make(chan struct{})
+		go func() {
+			res.Body.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s loop(%d) (2): Expected Close not to drain the whole stream", testName, i)
+		}
+	}
+
+	interactions := rec.Interactions()
+	if len(interactions) != 2 {
+		t.Fatalf("%s (3): Expected 2 interactions, got %d", testName, len(interactions))
+	}
+	if interactions[0].Truncated || !interactions[1].Truncated {
+		t.Errorf("%s (4): Expected only the stream to be truncated, got %t and %t", testName, interactions[0].Truncated, interactions[1].Truncated)
+	}
+	if size := interactions[1].responseBody.size; size > maxDrainSize+10 {
+		t.Errorf("%s (5): Expected at most %d bytes to be recorded, got %d", testName, maxDrainSize+10, size)
+	}
+}
+
+func TestReadCassette(t *testing.T) {
+	testName := "TestReadCassette"
+
+	large := strings.Repeat("some content", 1000)
+	// escaped slashes are valid JSON for base64 content, and a header named Body is kept
+	cassette := `{"interactions": [{
+		"request": {"method": "POST", "url": "http://example.com", "header": {"Body": ["a"]}, "body": "` +
+		strings.Replace(base64.StdEncoding.EncodeToString([]byte("some ??? content")), "/", `\/`, -1) + `"},
+		"response": {"status_code": 200, "header": {}, "body": "` + base64.StdEncoding.EncodeToString([]byte(large)) + `"}
+	}, {
+		"request": {"method": "GET", "url": "http://example.com", "header": {}, "body": ""},
+		"response": {"status_code": 204, "header": {}, "body": ""}
+	}]}`
+
+	interactions, err := readCassette(strings.NewReader(cassette), FormatJSON, 100, "", "")
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	defer func() {
+		for _, i := range interactions {
+			i.requestBody.close()
+			i.responseBody.close()
+		}
+	}()
+	if len(interactions) != 2 {
+		t.Fatalf("%s (2): Expected 2 interactions, got %d", testName, len(interactions))
+	}
+
+	first := interactions[0]
+	if expected, actual := "a", first.RequestHeader.Get("Body"); expected != actual {
+		t.Errorf("%s (3): Expected header to be '%s', got '%s'", testName, expected, actual)
+	}
+	for j, test := range []struct {
+		body     recordedBody
+		expected string
+	}{
+		{first.requestBody, "some ??? content"},
+		{first.responseBody, large},
+	} {
+		actual, _ := ioutil.ReadAll(test.body.reader())
+		if string(actual) != test.expected || test.body.size != int64(len(test.expected)) {
+			t.Errorf("%s loop(%d) (4): Expected a body of %d bytes to be decoded, got %d bytes of size %d", testName, j, len(test.expected), len(actual), test.body.size)
+		}
+	}
+	if !first.responseBody.ob.Spilled() {
+		t.Errorf("%s (5): Expected the large body to be decoded into a spilled buffer", testName)
+	}
+	if second := interactions[1]; second.requestBody.ob != nil || second.responseBody.ob != nil {
+		t.Errorf("%s (6): Expected empty bodies to have no buffers", testName)
+	}
+
+	if _, err := readCassette(strings.NewReader(`{"interactions": [{"request": {"body": "not base64"}}]}`), FormatJSON, 100, "", ""); err == nil {
+		t.Errorf("%s (7): Expected err to be non nil", testName)
+	}
+}
@@ -0,0 +1,255 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rszewczyk/pkg/ioutil"
+)
+
+const (
+	// DefaultMaxRetries is the number of times Retry will retry a request when MaxRetries is zero
+	DefaultMaxRetries = 3
+	// DefaultBaseDelay is the delay used by Retry to compute backoff when BaseDelay is zero
+	DefaultBaseDelay = 50 * time.Millisecond
+	// DefaultMaxDelay is the upper bound used by Retry for backoff when MaxDelay is zero
+	DefaultMaxDelay = 5 * time.Second
+	// IdempotencyKeyHeader is the header that marks a request with a non-idempotent method as safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// maxDrainSize bounds the number of bytes that will be read and discarded from a response that is going to be retried
+const maxDrainSize = 64 << 10
+
+// Retry is an http.RoundTripper that retries requests which fail with a connection error or a response status of
+// 429 or 503. Only requests with an idempotent method, or that carry an Idempotency-Key header, are retried.
+//
+// Retries are delayed using exponential backoff with jitter, or by the amount of time given in a Retry-After header
+// if that is longer. A retry that can't be made before the deadline of the request's context is not attempted; the
+// last response or error is returned instead.
+//
+// Request bodies are captured once into an ioutil.OverflowBuffer and replayed from there on each attempt.
+type Retry struct {
+	Transport http.RoundTripper
+	// MaxRetries is the maximum number of times a request will be retried. If zero, DefaultMaxRetries is used; if
+	// negative, requests are not retried.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, which doubles for each subsequent retry up to MaxDelay. If either
+	// is zero, DefaultBaseDelay and DefaultMaxDelay are used respectively.
+	BaseDelay, MaxDelay time.Duration
+	// Capacity, Dir and Prefix configure the OverflowBuffer that request bodies are captured into
+	Capacity    int
+	Dir, Prefix string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := roundTripper(t.Transport)
+	if !isIdempotent(req) {
+		return rt.RoundTrip(req)
+	}
+
+	ob, _, err := captureBody(req, t.Capacity, t.Dir, t.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetries := t.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		r, body := replayRequest(req, ob)
+		res, err := rt.RoundTrip(r)
+
+		if attempt == maxRetries || !shouldRetry(req, res, err) {
+			body.release(ob)
+			return res, err
+		}
+
+		delay := t.backoff(attempt, res)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			body.release(ob)
+			return res, err
+		}
+
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainSize))
+			res.Body.Close()
+		}
+		body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if ob != nil {
+				ob.Close()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Wrap returns a copy of t that uses next as its Transport. Wrap can be used as a middleware with Compose.
+func (t Retry) Wrap(next http.RoundTripper) http.RoundTripper {
+	t.Transport = next
+	return &t
+}
+
+func (t *Retry) backoff(attempt int, res *http.Response) time.Duration {
+	base, max := t.BaseDelay, t.MaxDelay
+	if base == 0 {
+		base = DefaultBaseDelay
+	}
+	if max == 0 {
+		max = DefaultMaxDelay
+	}
+
+	delay := max
+	if attempt < 32 && base<<uint(attempt) < max {
+		delay = base << uint(attempt)
+	}
+	// half of the delay is fixed and the other half is random
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	if res != nil {
+		if after := retryAfter(res.Header.Get("Retry-After")); after > delay {
+			delay = after
+		}
+	}
+	return delay
+}
+
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+func shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		// errors caused by the request's context ending are not connection errors
+		return req.Context().Err() == nil && isConnectionError(err)
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable
+}
+
+// isConnectionError reports whether err is a network error or the connection was broken, as opposed to an error
+// such as an invalid request or certificate that retrying won't fix
+func isConnectionError(err error) bool {
+	// a url.Error is a net.Error whatever it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// captureBody reads the body of req into an OverflowBuffer, which will be nil if req has no body. The number of
+// bytes captured is also returned.
+func captureBody(req *http.Request, capacity int, dir, prefix string) (*ioutil.OverflowBuffer, int64, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, 0, nil
+	}
+	defer req.Body.Close()
+
+	ob := &ioutil.OverflowBuffer{Capacity: capacity, Dir: dir, Prefix: prefix}
+	n, err := io.Copy(ob, req.Body)
+	if err != nil {
+		ob.Close()
+		return nil, 0, err
+	}
+	return ob, n, nil
+}
+
+// replayRequest returns a shallow copy of req whose body reads the content of ob from the beginning
+func replayRequest(req *http.Request, ob *ioutil.OverflowBuffer) (*http.Request, *replayBody) {
+	body := new(replayBody)
+	if ob == nil {
+		return req, body
+	}
+
+	ob.Rewind()
+	body.r = ob
+	r := new(http.Request)
+	*r = *req
+	r.Body = body
+	r.GetBody = nil
+	return r, body
+}
+
+// replayBody is a request body that reads from a shared OverflowBuffer. Closing a replayBody waits for any Read in
+// progress to finish, after which the buffer can safely be rewound for another attempt.
+type replayBody struct {
+	mu      sync.Mutex
+	r       io.Reader
+	closed  bool
+	onClose func() error
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	return b.r.Read(p)
+}
+
+func (b *replayBody) Close() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	if b.onClose != nil {
+		err = b.onClose()
+	}
+	return
+}
+
+// release closes ob once the body has been closed by the transport that it was sent with. The transport may still be
+// reading the body of the final attempt after returning a response, so ob can't be closed any sooner.
+func (b *replayBody) release(ob *ioutil.OverflowBuffer) {
+	if ob == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		ob.Close()
+		return
+	}
+	b.onClose = ob.Close
+}
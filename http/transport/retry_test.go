@@ -0,0 +1,192 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyServer responds with status to the first failures requests and echoes the request body after that
+func flakyServer(failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	attempts := new(int32)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(attempts, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(body)
+	})), attempts
+}
+
+func TestRetry(t *testing.T) {
+	testName := "TestRetry"
+
+	expectedContent := []byte(strings.Repeat("some content", 100))
+	tests := []struct {
+		method, idempotencyKey string
+		status                 int
+		failures               int32
+		expectedAttempts       int32
+		expectedStatus         int
+	}{
+		{http.MethodPut, "", http.StatusServiceUnavailable, 2, 3, http.StatusOK},
+		{http.MethodPut, "", http.StatusTooManyRequests, 1, 2, http.StatusOK},
+		{http.MethodPut, "", http.StatusInternalServerError, 1, 1, http.StatusInternalServerError},
+		{http.MethodPut, "", http.StatusServiceUnavailable, 10, 4, http.StatusServiceUnavailable},
+		{http.MethodPost, "", http.StatusServiceUnavailable, 1, 1, http.StatusServiceUnavailable},
+		{http.MethodPost, "abc", http.StatusServiceUnavailable, 1, 2, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		svr, attempts := flakyServer(test.failures, test.status, "")
+		defer svr.Close()
+
+		req, _ := http.NewRequest(test.method, svr.URL, bytes.NewReader(expectedContent))
+		if test.idempotencyKey != "" {
+			req.Header.Set(IdempotencyKeyHeader, test.idempotencyKey)
+		}
+		c := &http.Client{Transport: &Retry{BaseDelay: time.Millisecond, Capacity: 100}}
+
+		res, err := c.Do(req)
+		if err != nil {
+			t.Errorf("%s loop(%d) (1): Expected err to be nil, got %s", testName, i, err)
+			continue
+		}
+		actualContent, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if expected, actual := test.expectedStatus, res.StatusCode; expected != actual {
+			t.Errorf("%s loop(%d) (2): Expected status to be %d, got %d", testName, i, expected, actual)
+		}
+		if expected, actual := test.expectedAttempts, atomic.LoadInt32(attempts); expected != actual {
+			t.Errorf("%s loop(%d) (3): Expected %d attempts, got %d", testName, i, expected, actual)
+		}
+		if res.StatusCode == http.StatusOK && !bytes.Equal(expectedContent, actualContent) {
+			t.Errorf("%s loop(%d) (4): Expected the request body to be replayed, got '%s'", testName, i, actualContent)
+		}
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	testName := "TestRetryConnectionError"
+
+	svr := httptest.NewServer(http.NotFoundHandler())
+	svr.Close()
+
+	attempts := 0
+	c := &http.Client{Transport: &Retry{
+		BaseDelay: time.Millisecond,
+		Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}}
+
+	if _, err := c.Get(svr.URL); err == nil {
+		t.Errorf("%s (1): Expected err to be non nil", testName)
+	}
+	if expected, actual := DefaultMaxRetries+1, attempts; expected != actual {
+		t.Errorf("%s (2): Expected %d attempts, got %d", testName, expected, actual)
+	}
+}
+
+func TestRetryErrors(t *testing.T) {
+	testName := "TestRetryErrors"
+
+	tests := []struct {
+		err              error
+		maxRetries       int
+		expectedAttempts int
+	}{
+		{io.ErrUnexpectedEOF, 0, DefaultMaxRetries + 1},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, 1, 2},
+		{fmt.Errorf("write: %w", syscall.ECONNRESET), 0, DefaultMaxRetries + 1},
+		{io.ErrUnexpectedEOF, -1, 1},
+		{errors.New("x509: certificate signed by unknown authority"), 0, 1},
+		{errors.New("unsupported protocol scheme"), 0, 1},
+	}
+
+	for i, test := range tests {
+		attempts := 0
+		c := &http.Client{Transport: &Retry{
+			MaxRetries: test.maxRetries,
+			BaseDelay:  time.Millisecond,
+			Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				return nil, test.err
+			}),
+		}}
+
+		if _, err := c.Get("http://example.com"); err == nil {
+			t.Errorf("%s loop(%d) (1): Expected err to be non nil", testName, i)
+		}
+		if expected, actual := test.expectedAttempts, attempts; expected != actual {
+			t.Errorf("%s loop(%d) (2): Expected %d attempts, got %d", testName, i, expected, actual)
+		}
+	}
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	testName := "TestRetryHonoursRetryAfter"
+
+	svr, _ := flakyServer(1, http.StatusTooManyRequests, "1")
+	defer svr.Close()
+
+	start := time.Now()
+	c := &http.Client{Transport: &Retry{BaseDelay: time.Millisecond}}
+	res, err := c.Get(svr.URL)
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if expected, actual := http.StatusOK, res.StatusCode; expected != actual {
+		t.Errorf("%s (2): Expected status to be %d, got %d", testName, expected, actual)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("%s (3): Expected the retry to wait for at least 1s, waited %s", testName, elapsed)
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	testName := "TestRetryRespectsDeadline"
+
+	svr, attempts := flakyServer(1, http.StatusServiceUnavailable, "10")
+	defer svr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+
+	start := time.Now()
+	res, err := (&http.Client{Transport: &Retry{}}).Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if expected, actual := http.StatusServiceUnavailable, res.StatusCode; expected != actual {
+		t.Errorf("%s (2): Expected status to be %d, got %d", testName, expected, actual)
+	}
+	if expected, actual := int32(1), atomic.LoadInt32(attempts); expected != actual {
+		t.Errorf("%s (3): Expected %d attempts, got %d", testName, expected, actual)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("%s (4): Expected not to wait for a retry that would exceed the deadline, waited %s", testName, elapsed)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Package transport provides types that implement http.RoundTripper for use by HTTP clients, along with utilities
+for composing them
+
+Each RoundTripper in this package wraps another RoundTripper, held in its Transport field, which is used to make
+the actual requests. If Transport is nil then http.DefaultTransport is used.
+
+A client middleware is a function with the following signature:
+
+	func(next http.RoundTripper) http.RoundTripper
+
+The returned RoundTripper either produces the response itself or calls the RoundTrip method of the next RoundTripper.
+
+The Wrap method of each RoundTripper in this package is such a middleware. Retry's Wrap returns a copy, so it can wrap
+any number of RoundTrippers. Hedge, Breaker and Recorder hold state, in the latencies, circuits and interactions that
+they record, so their Wrap methods set the Transport of the receiver itself, which must only wrap one RoundTripper.
+
+Example
+
+	package main
+
+	import (
+	        "log"
+	        "net/http"
+	        "time"
+
+	        "github.com/rszewczyk/pkg/http/transport"
+	)
+
+	func UserAgent(next http.RoundTripper) http.RoundTripper {
+	        return transport.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+	                r = r.Clone(r.Context())
+	                r.Header.Set("User-Agent", "example/1.0")
+	                return next.RoundTrip(r)
+	        })
+	}
+
+	func main() {
+	        retry := transport.Retry{MaxRetries: 5, BaseDelay: 100 * time.Millisecond}
+	        c := transport.NewClient(UserAgent, retry.Wrap)
+	        res, err := c.Get("http://example.com")
+	        if err != nil {
+	                log.Fatal(err)
+	        }
+	        defer res.Body.Close()
+	}
+*/
+package transport
+
+import "net/http"
+
+// RoundTripperFunc allows an ordinary function to be used as an http.RoundTripper
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(r)
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Compose returns a middleware that is a composition of the argument middlewares. The middlewares are composed in reverse
+// argument order - i.e. the last argument is the innermost middleware and is the closest to the network.
+func Compose(middlewares ...func(http.RoundTripper) http.RoundTripper) func(http.RoundTripper) http.RoundTripper {
+	return func(last http.RoundTripper) (composition http.RoundTripper) {
+		composition = last
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			composition = middlewares[i](composition)
+		}
+		return
+	}
+}
+
+// NewClient returns an http.Client whose Transport is the composition of middlewares wrapping http.DefaultTransport
+func NewClient(middlewares ...func(http.RoundTripper) http.RoundTripper) *http.Client {
+	return &http.Client{Transport: Compose(middlewares...)(http.DefaultTransport)}
+}
+
+func roundTripper(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		return http.DefaultTransport
+	}
+	return rt
+}
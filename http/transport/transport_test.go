@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type callOrder []int
+
+func (c *callOrder) wrapper(step int) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			*c = append(*c, step)
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+func TestCompose(t *testing.T) {
+	testName := "TestCompose"
+
+	var (
+		expectedOrder []int
+		actualOrder   = new(callOrder)
+		middlewares   []func(http.RoundTripper) http.RoundTripper
+		wasCalled     bool
+	)
+
+	for i := 0; i < 10; i++ {
+		expectedOrder = append(expectedOrder, i)
+		middlewares = append(middlewares, actualOrder.wrapper(i))
+	}
+
+	// the wrapped RoundTripper should be last
+	expectedOrder = append(expectedOrder, 11)
+
+	Compose(middlewares...)(RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		wasCalled = true
+		*actualOrder = append(*actualOrder, 11)
+		return nil, nil
+	})).RoundTrip(&http.Request{})
+
+	if !wasCalled {
+		t.Error(testName + " (1): wrapped RoundTripper was not called")
+	}
+	if !intSlicesAreEqual(expectedOrder, *actualOrder) {
+		t.Errorf("%s: (2): Expected call order was %v, got %v", testName, expectedOrder, *actualOrder)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	testName := "TestNewClient"
+
+	svr, attempts := flakyServer(1, http.StatusServiceUnavailable, "")
+	defer svr.Close()
+
+	actualOrder := new(callOrder)
+	retry := Retry{BaseDelay: time.Millisecond}
+	c := NewClient(actualOrder.wrapper(0), retry.Wrap, actualOrder.wrapper(1))
+
+	res, err := c.Get(svr.URL)
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if expected, actual := http.StatusOK, res.StatusCode; expected != actual {
+		t.Errorf("%s (2): Expected status to be %d, got %d", testName, expected, actual)
+	}
+	if expected, actual := int32(2), atomic.LoadInt32(attempts); expected != actual {
+		t.Errorf("%s (3): Expected %d attempts, got %d", testName, expected, actual)
+	}
+	// the outer middleware sees the request once and the inner one sees each attempt
+	if expected := []int{0, 1, 1}; !intSlicesAreEqual(expected, *actualOrder) {
+		t.Errorf("%s (4): Expected call order was %v, got %v", testName, expected, *actualOrder)
+	}
+	if retry.Transport != nil {
+		t.Errorf("%s (5): Expected Wrap not to modify the original Retry", testName)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	testName := "TestWrap"
+
+	svr, attempts := flakyServer(1, http.StatusServiceUnavailable, "")
+	defer svr.Close()
+
+	retry := Retry{BaseDelay: time.Millisecond}
+	hedge := &Hedge{Delay: time.Minute}
+	breaker := &Breaker{}
+	recorder := &Recorder{Mode: ModeRecord, Path: filepath.Join(t.TempDir(), "cassette.json")}
+	c := NewClient(recorder.Wrap, breaker.Wrap, hedge.Wrap, retry.Wrap)
+
+	res, err := c.Get(svr.URL)
+	if err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	res.Body.Close()
+
+	if expected, actual := http.StatusOK, res.StatusCode; expected != actual {
+		t.Errorf("%s (2): Expected status to be %d, got %d", testName, expected, actual)
+	}
+	if expected, actual := int32(2), atomic.LoadInt32(attempts); expected != actual {
+		t.Errorf("%s (3): Expected %d attempts, got %d", testName, expected, actual)
+	}
+	if recorder.Transport != breaker || breaker.Transport != hedge {
+		t.Errorf("%s (4): Expected Wrap to set the Transport of the stateful RoundTrippers", testName)
+	}
+	if n := len(recorder.Interactions()); n != 1 {
+		t.Errorf("%s (5): Expected 1 interaction to be recorded, got %d", testName, n)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Errorf("%s (6): Expected err to be nil, got %s", testName, err)
+	}
+}
+
+func intSlicesAreEqual(first, second []int) bool {
+	if first == nil && second == nil {
+		return true
+	}
+	if len(first) != len(second) {
+		return false
+	}
+	for i, s := range first {
+		if second[i] != s {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is the error with which a request is aborted when nothing has been written to its body within
+// PipeOptions.IdleTimeout
+var ErrIdleTimeout = errors.New("request body idle timeout")
+
+// Progress describes how much of a request body has been sent
+type Progress struct {
+	// Sent is the number of bytes written so far and Total is the expected length of the body, or -1 if unknown
+	Sent, Total int64
+	Elapsed     time.Duration
+	// Rate is the average number of bytes sent per second
+	Rate float64
+	// ETA is the estimated time remaining, or -1 if the total length is unknown
+	ETA time.Duration
+	// Done is true for the final report, which is made when the writer is closed
+	Done bool
+}
+
+// PipeOptions configures the writer returned by PipeWriterWithOptions
+type PipeOptions struct {
+	// OnProgress, if non-nil, is called from Write at most once every ProgressInterval (or after every write if
+	// ProgressInterval is zero), and once more from Close. The expected total length is taken from the request's
+	// ContentLength when it is greater than zero.
+	OnProgress       func(Progress)
+	ProgressInterval time.Duration
+	// BytesPerSecond, if greater than zero, limits the rate at which the body is sent using a token bucket that holds
+	// up to Burst bytes. If Burst is zero it defaults to BytesPerSecond.
+	BytesPerSecond int64
+	Burst          int
+	// IdleTimeout, if greater than zero, aborts the request with ErrIdleTimeout if the writer isn't written to or
+	// closed within IdleTimeout of the previous write (or of the writer being created)
+	IdleTimeout time.Duration
+	// ContentEncoding, if non-empty, is the name of a registered Encoding with which the body is compressed as it is
+	// written. The Content-Encoding header is set accordingly. Progress is reported in uncompressed bytes, whereas
+	// BytesPerSecond limits the rate at which compressed bytes are sent.
+	ContentEncoding string
+	// Digest, if non-empty, is the algorithm (DigestSHA256 or DigestCRC32C) of a digest of the body that is computed
+	// as it is written and sent in a Content-Digest trailer. Since trailers can only be sent with a chunked body, the
+	// request's ContentLength is ignored. When used with ContentEncoding the digest is of the compressed body.
+	Digest string
+}
+
+// PipeWriterWithOptions is like PipeWriter, with support for compression, progress reporting, throttling and an idle
+// timeout as configured by opts. Throttled writes are abandoned if the request's context is done. If opts can't be
+// applied the request isn't executed; the error is returned by Write and Close and placed on resultCh.
+func PipeWriterWithOptions(c *http.Client, req *http.Request, opts PipeOptions, resultCh chan<- Result) (w io.WriteCloser) {
+	total := req.ContentLength
+	if total <= 0 {
+		total = -1
+	}
+	uw := &uploadWriter{opts: opts, total: total}
+
+	fail := func(err error) io.WriteCloser {
+		uw.err = err
+		go func() { resultCh <- Result{Request: req, Error: err} }()
+		return uw
+	}
+
+	var enc Encoding
+	if opts.ContentEncoding != "" {
+		var err error
+		if enc, err = lookupEncoding(opts.ContentEncoding); err != nil {
+			return fail(err)
+		}
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		req.Header.Set("Content-Encoding", opts.ContentEncoding)
+		// the length of the compressed body isn't known
+		req.ContentLength = 0
+	}
+	if opts.Digest != "" {
+		var err error
+		if uw.digest, err = newDigestHash(opts.Digest); err != nil {
+			return fail(err)
+		}
+		// the trailer has to be announced before the request is sent and its value set before the body is closed
+		req.Trailer = http.Header{ContentDigestHeaderKey: nil}
+		req.ContentLength = 0
+		uw.req = req
+	}
+
+	uw.pw = pipeWriter(c, req, resultCh)
+	uw.start = time.Now()
+	uw.w = uw.pw
+	if opts.BytesPerSecond > 0 {
+		burst := opts.Burst
+		if burst <= 0 {
+			burst = int(opts.BytesPerSecond)
+		}
+		uw.w = &throttledWriter{w: uw.w, ctx: req.Context(), bucket: newTokenBucket(float64(opts.BytesPerSecond), burst, uw.start)}
+	}
+	if uw.digest != nil {
+		uw.w = &hashingWriter{w: uw.w, h: uw.digest}
+	}
+	if opts.ContentEncoding != "" {
+		if uw.enc, uw.err = enc.NewWriter(uw.w); uw.err != nil {
+			uw.pw.CloseWithError(uw.err)
+			return uw
+		}
+		uw.w = uw.enc
+	}
+	if opts.IdleTimeout > 0 {
+		uw.idle = time.AfterFunc(opts.IdleTimeout, func() {
+			atomic.StoreInt32(&uw.timedOut, 1)
+			uw.pw.CloseWithError(ErrIdleTimeout)
+		})
+	}
+	return uw
+}
+
+type uploadWriter struct {
+	pw   *io.PipeWriter
+	opts PipeOptions
+	// w is what the body is written to, which is either pw or a chain of compressing, hashing and throttling
+	// writers that ends with pw
+	w      io.Writer
+	enc    io.WriteCloser
+	digest hash.Hash
+	req    *http.Request
+	idle   *time.Timer
+	err    error
+
+	timedOut     int32
+	total, sent  int64
+	start        time.Time
+	lastProgress time.Time
+}
+
+func (uw *uploadWriter) Write(p []byte) (n int, err error) {
+	if uw.err != nil {
+		return 0, uw.err
+	}
+	if uw.idle != nil {
+		if !uw.idle.Stop() {
+			return 0, uw.idleErr()
+		}
+		defer uw.idle.Reset(uw.opts.IdleTimeout)
+	}
+
+	n, err = uw.w.Write(p)
+	uw.sent += int64(n)
+	if uw.opts.OnProgress != nil && time.Since(uw.lastProgress) >= uw.opts.ProgressInterval {
+		uw.report(false)
+	}
+	return
+}
+
+func (uw *uploadWriter) Close() error {
+	if uw.err != nil {
+		return uw.err
+	}
+	if uw.idle != nil && !uw.idle.Stop() {
+		return uw.idleErr()
+	}
+	if uw.enc != nil {
+		if err := uw.enc.Close(); err != nil {
+			uw.pw.CloseWithError(err)
+			return err
+		}
+	}
+	if uw.digest != nil {
+		uw.req.Trailer.Set(ContentDigestHeaderKey, digestValue(uw.opts.Digest, uw.digest.Sum(nil)))
+	}
+	if uw.opts.OnProgress != nil {
+		uw.report(true)
+	}
+	return uw.pw.Close()
+}
+
+func (uw *uploadWriter) idleErr() error {
+	if atomic.LoadInt32(&uw.timedOut) == 1 {
+		return ErrIdleTimeout
+	}
+	return io.ErrClosedPipe
+}
+
+func (uw *uploadWriter) report(done bool) {
+	now := time.Now()
+	uw.lastProgress = now
+
+	p := Progress{Sent: uw.sent, Total: uw.total, Elapsed: now.Sub(uw.start), ETA: -1, Done: done}
+	if p.Elapsed > 0 {
+		p.Rate = float64(p.Sent) / p.Elapsed.Seconds()
+	}
+	if p.Total >= 0 {
+		switch {
+		case p.Sent >= p.Total:
+			p.ETA = 0
+		case p.Rate > 0:
+			p.ETA = time.Duration(float64(p.Total-p.Sent) / p.Rate * float64(time.Second))
+		}
+	}
+	uw.opts.OnProgress(p)
+}
+
+// throttledWriter writes to w at a rate limited by bucket, in chunks of at most the bucket's burst size
+type throttledWriter struct {
+	w      io.Writer
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tw.bucket.burst {
+			chunk = chunk[:tw.bucket.burst]
+		}
+		if err = tw.bucket.wait(tw.ctx, len(chunk)); err != nil {
+			return
+		}
+
+		var nw int
+		nw, err = tw.w.Write(chunk)
+		n += nw
+		if err != nil {
+			return
+		}
+		p = p[nw:]
+	}
+	return
+}
+
+// tokenBucket is a token bucket rate limiter, where each token is a byte. Tokens are allowed to go into debt, in
+// which case the caller waits until the debt has been repaid.
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
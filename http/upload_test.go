@@ -0,0 +1,109 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newDiscardServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+}
+
+func TestPipeWriterWithOptionsProgress(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsProgress"
+
+	svr := newDiscardServer()
+	defer svr.Close()
+
+	content := bytes.Repeat([]byte("x"), 1000)
+	req, _ := http.NewRequest(http.MethodPut, svr.URL, nil)
+	req.ContentLength = int64(len(content))
+
+	var reports []Progress
+	resultCh := make(chan Result, 1)
+	w := PipeWriterWithOptions(nil, req, PipeOptions{OnProgress: func(p Progress) { reports = append(reports, p) }}, resultCh)
+	for i := 0; i < 4; i++ {
+		w.Write(content[i*250 : (i+1)*250])
+	}
+	w.Close()
+
+	result := <-resultCh
+	if result.Error != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, result.Error)
+	}
+	result.Close()
+
+	if expected, actual := 5, len(reports); expected != actual {
+		t.Fatalf("%s (2): Expected %d progress reports, got %d", testName, expected, actual)
+	}
+	for i, p := range reports[:4] {
+		if expected, actual := int64((i+1)*250), p.Sent; expected != actual {
+			t.Errorf("%s (3): Expected report %d to have sent %d bytes, got %d", testName, i, expected, actual)
+		}
+		if expected, actual := int64(len(content)), p.Total; expected != actual {
+			t.Errorf("%s (4): Expected report %d to have a total of %d, got %d", testName, i, expected, actual)
+		}
+		if p.Done || p.ETA < 0 {
+			t.Errorf("%s (5): Expected report %d to be incomplete with an ETA, got %+v", testName, i, p)
+		}
+	}
+	if last := reports[4]; !last.Done || last.ETA != 0 {
+		t.Errorf("%s (6): Expected the final report to be done with an ETA of 0, got %+v", testName, last)
+	}
+}
+
+func TestPipeWriterWithOptionsThrottle(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsThrottle"
+
+	svr := newDiscardServer()
+	defer svr.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, svr.URL, nil)
+	resultCh := make(chan Result, 1)
+	w := PipeWriterWithOptions(nil, req, PipeOptions{BytesPerSecond: 1000, Burst: 100}, resultCh)
+
+	// the first 100 bytes are covered by the initial burst
+	start := time.Now()
+	w.Write(bytes.Repeat([]byte("x"), 500))
+	w.Close()
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("%s (1): Expected writing 500 bytes at 1000 bytes/s to take about 400ms, took %s", testName, elapsed)
+	}
+
+	result := <-resultCh
+	if result.Error != nil {
+		t.Fatalf("%s (2): Expected err to be nil, got %s", testName, result.Error)
+	}
+	result.Close()
+}
+
+func TestPipeWriterWithOptionsIdleTimeout(t *testing.T) {
+	testName := "TestPipeWriterWithOptionsIdleTimeout"
+
+	svr := newDiscardServer()
+	defer svr.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, svr.URL, nil)
+	resultCh := make(chan Result, 1)
+	w := PipeWriterWithOptions(nil, req, PipeOptions{IdleTimeout: 50 * time.Millisecond}, resultCh)
+
+	if _, err := w.Write([]byte("some content")); err != nil {
+		t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+
+	result := <-resultCh
+	if !errors.Is(result.Error, ErrIdleTimeout) {
+		result.Close()
+		t.Errorf("%s (2): Expected ErrIdleTimeout, got %v", testName, result.Error)
+	}
+	if _, err := w.Write([]byte("more content")); err != ErrIdleTimeout {
+		t.Errorf("%s (3): Expected ErrIdleTimeout, got %v", testName, err)
+	}
+}
@@ -6,25 +6,32 @@ import (
 )
 
 // Result represents the result of executing an HTTP request. It holds any response and error
-// obtained as well as the original request.
+// obtained as well as the original request. Timings holds the timings that were recorded while
+// the request was executed, if any.
 type Result struct {
 	Response *http.Response
 	Request  *http.Request
 	Error    error
+	Timings  Timings
 }
 
 // PipeWriter allows an http request body to be streamed through a writer. It executes req using c (if
 // c is nil then http.DefaultClient will be used). Callers must close w when finished writing the request
-// body. The result will be placed on resultCh.
+// body. The result, along with the timings recorded while executing req, will be placed on resultCh.
 func PipeWriter(c *http.Client, req *http.Request, resultCh chan<- Result) (w io.WriteCloser) {
+	return pipeWriter(c, req, resultCh)
+}
+
+func pipeWriter(c *http.Client, req *http.Request, resultCh chan<- Result) (w *io.PipeWriter) {
 	if c == nil {
 		c = http.DefaultClient
 	}
 	req.Body, w = io.Pipe()
 
+	traced, timings := TraceTimings(req)
 	go func() {
-		res, err := c.Do(req)
-		resultCh <- Result{res, req, err}
+		res, err := c.Do(traced)
+		resultCh <- Result{Response: res, Request: req, Error: err, Timings: timings()}
 	}()
 	return
 }
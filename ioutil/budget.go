@@ -0,0 +1,101 @@
+package ioutil
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+)
+
+// ErrBudgetExceeded is returned by OverflowBuffer.Write when writing would exceed the disk limit of its Budget
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget limits the memory and disk space used by a group of OverflowBuffers, such as all the buffers used to handle
+// requests in a server. A buffer draws on its Budget as it is written to and returns what it drew when it is closed.
+// When the memory limit has been reached buffers overflow to disk before reaching their Capacity; when the disk limit
+// has been reached writes fail with ErrBudgetExceeded.
+//
+// A Budget may be used by any number of buffers at once.
+type Budget struct {
+	// Memory and Disk are the number of bytes that may be held in memory and on disk. Zero means no limit. Disk is
+	// counted in the bytes written to the buffers, before they are compressed.
+	Memory, Disk int64
+
+	mu                 sync.Mutex
+	memUsed, diskUsed  int64
+	spills, exceedings int64
+}
+
+// BudgetStats is a snapshot of the usage of a Budget
+type BudgetStats struct {
+	Memory, MemoryUsed int64
+	Disk, DiskUsed     int64
+	// Spills is the number of buffers that have overflowed to disk and Exceedings is the number of writes that failed
+	// with ErrBudgetExceeded
+	Spills, Exceedings int64
+}
+
+// Get returns an OverflowBuffer from the pool, as GetOverflowBufferFromPool does, that draws on b
+func (b *Budget) Get(capacity int, dir, prefix string) *OverflowBuffer {
+	ob := GetOverflowBufferFromPool(capacity, dir, prefix)
+	ob.Budget = b
+	return ob
+}
+
+// Stats returns a snapshot of the usage of b
+func (b *Budget) Stats() BudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BudgetStats{
+		Memory:     b.Memory,
+		MemoryUsed: b.memUsed,
+		Disk:       b.Disk,
+		DiskUsed:   b.diskUsed,
+		Spills:     b.spills,
+		Exceedings: b.exceedings,
+	}
+}
+
+// Publish exports the stats of b as an expvar variable with the given name. Like expvar.Publish, it panics if the name
+// is already in use.
+func (b *Budget) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return b.Stats() }))
+}
+
+// reserveMemory draws up to n bytes of memory, returning the number drawn
+func (b *Budget) reserveMemory(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Memory > 0 && b.memUsed+int64(n) > b.Memory {
+		n = int(b.Memory - b.memUsed)
+		if n < 0 {
+			n = 0
+		}
+	}
+	b.memUsed += int64(n)
+	return n
+}
+
+// reserveDisk draws n bytes of disk space, or returns false if that would exceed the limit
+func (b *Budget) reserveDisk(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Disk > 0 && b.diskUsed+n > b.Disk {
+		b.exceedings++
+		return false
+	}
+	b.diskUsed += n
+	return true
+}
+
+func (b *Budget) spilled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spills++
+}
+
+func (b *Budget) release(mem, disk int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.memUsed -= mem
+	b.diskUsed -= disk
+}
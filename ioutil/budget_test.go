@@ -0,0 +1,105 @@
+package ioutil
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBudgetMemory(t *testing.T) {
+	testName := "TestBudgetMemory"
+
+	b := &Budget{Memory: 100}
+	first, second := b.Get(80, "", ""), b.Get(80, "", "")
+	if first.Budget != b {
+		t.Errorf("%s (1): Expected the buffer to draw on the budget", testName)
+	}
+
+	content := bytes.Repeat([]byte("x"), 80)
+	first.Write(content)
+	second.Write(content)
+	if first.Spilled() {
+		t.Errorf("%s (2): Expected the first buffer to be held in memory", testName)
+	}
+	if !second.Spilled() {
+		t.Errorf("%s (3): Expected the second buffer to spill early", testName)
+	}
+	if stats := b.Stats(); stats.MemoryUsed != 100 || stats.DiskUsed != 60 || stats.Spills != 1 {
+		t.Errorf("%s (4): Expected 100 bytes of memory, 60 bytes of disk and 1 spill to be used, got %+v", testName, stats)
+	}
+	if actual, _ := ioutil.ReadAll(second); !bytes.Equal(content, actual) {
+		t.Errorf("%s (5): Expected the content to be the same, got %s", testName, actual)
+	}
+
+	cleanup(t, testName, first)
+	cleanup(t, testName, second)
+	ReleaseOverflowBufferToPool(first)
+	ReleaseOverflowBufferToPool(second)
+	if stats := b.Stats(); stats.MemoryUsed != 0 || stats.DiskUsed != 0 {
+		t.Errorf("%s (6): Expected everything to be released, got %+v", testName, stats)
+	}
+}
+
+func TestBudgetDisk(t *testing.T) {
+	testName := "TestBudgetDisk"
+
+	b := &Budget{Disk: 50}
+	ob := &OverflowBuffer{Capacity: 10, Budget: b}
+	r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+
+	_, err := ob.Write(bytes.Repeat([]byte("x"), 30))
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("%s (1): Expected ErrBudgetExceeded, got %v", testName, err)
+	}
+	if stats := b.Stats(); stats.DiskUsed != 30 || stats.Exceedings != 1 {
+		t.Errorf("%s (2): Expected 30 bytes of disk and 1 exceeding, got %+v", testName, stats)
+	}
+
+	// what was written before the budget was exceeded is intact
+	check(t, testName+" (3)", ob, r)
+	cleanup(t, testName, ob)
+	if stats := b.Stats(); stats.DiskUsed != 0 {
+		t.Errorf("%s (4): Expected disk to be released, got %+v", testName, stats)
+	}
+}
+
+func TestBudgetReadFrom(t *testing.T) {
+	testName := "TestBudgetReadFrom"
+
+	b := &Budget{Memory: 10, Disk: 100}
+	ob := &OverflowBuffer{Capacity: 20, Budget: b}
+	if _, err := ob.ReadFrom(strings.NewReader(strings.Repeat("x", 200))); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("%s (1): Expected ErrBudgetExceeded, got %v", testName, err)
+	}
+	if stats := b.Stats(); stats.MemoryUsed != 10 || stats.DiskUsed > 100 {
+		t.Errorf("%s (2): Expected the limits to be respected, got %+v", testName, stats)
+	}
+	cleanup(t, testName, ob)
+}
+
+// budgetPublishRuns makes the name published by each run of TestBudgetPublish unique, since expvar names can't be reused
+var budgetPublishRuns int
+
+func TestBudgetPublish(t *testing.T) {
+	testName := "TestBudgetPublish"
+	budgetPublishRuns++
+	name := fmt.Sprintf("%s-%d", testName, budgetPublishRuns)
+
+	b := &Budget{Memory: 1000}
+	b.Publish(name)
+	ob := &OverflowBuffer{Capacity: 100, Budget: b}
+	ob.Write([]byte("some content"))
+	defer ob.Close()
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("%s (1): Expected the budget to be published", testName)
+	}
+	if actual := v.String(); !strings.Contains(actual, `"MemoryUsed":12`) {
+		t.Errorf("%s (2): Expected the published stats to include the memory used, got %s", testName, actual)
+	}
+}
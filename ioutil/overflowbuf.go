@@ -1,17 +1,14 @@
 package ioutil
 
 import (
+	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"sync"
 )
 
-var freeOverflowBuffers = sync.Pool{
-	New: func() interface{} { return new(OverflowBuffer) },
-}
+// ErrTooLarge is returned by OverflowBuffer.Write when writing would exceed the buffer's MaxSize
+var ErrTooLarge = errors.New("buffer too large")
 
 // OverflowBuffer is a byte buffer that overflows to disk when its capacity has been reached
 type OverflowBuffer struct {
@@ -19,35 +16,37 @@ type OverflowBuffer struct {
 	Capacity int
 	// Dir and Prefix control the location of the backing files in the same manner as the standard library's ioutil.TempFile
 	Dir, Prefix string
+	// Spiller, if non-nil, creates the backing file, to which Dir and Prefix are passed. If nil, TempFileSpiller is used.
+	Spiller Spiller
+	// OnSpill, if non-nil, is called when the capacity is first exceeded, once the backing file has been created
+	OnSpill func(ob *OverflowBuffer)
+	// Budget, if non-nil, limits the memory and disk space used by the buffer together with other buffers
+	Budget *Budget
+	// MaxSize, if greater than zero, is the total number of bytes, in memory and on disk, that the buffer will hold
+	MaxSize int64
+	// Encrypt, if true, encrypts what overflows to disk with a key that is generated for the buffer and never leaves
+	// memory, so that the backing file can't be read by anyone else, even after the process has exited
+	Encrypt bool
+	// Compress, if true, compresses what overflows to disk with DEFLATE at CompressionLevel, which is one of the levels
+	// of the standard library's compress/flate package. If CompressionLevel is zero, flate.DefaultCompression is used.
+	// The disk space drawn from the Budget is the uncompressed size, since the compressed size isn't known until a
+	// chunk has been written, so the Budget's disk limit is an upper bound on what compressed buffers store.
+	//
+	// With Encrypt or Compress, what overflows is written to disk in chunks of 64 KiB. The chunk that is being filled,
+	// and the last one that was read, are held in memory in addition to Capacity and aren't drawn from the Budget.
+	Compress         bool
+	CompressionLevel int
 
 	buf                                  []byte
 	nwrote, nread                        int
-	f                                    *os.File
+	size, memReserved, diskReserved      int64
+	f                                    SpillFile
 	eof, fileWasResetForRead, readCalled bool
-}
-
-// GetOverflowBufferFromPool returns an OverflowBuffer with the given Capacity, Dir and Prefix from a sync.Pool
-func GetOverflowBufferFromPool(capacity int, dir, prefix string) *OverflowBuffer {
-	fb := freeOverflowBuffers.Get().(*OverflowBuffer)
-	fb.Capacity = capacity
-	fb.Dir = dir
-	fb.Prefix = prefix
-	return fb
-}
-
-// ReleaseOverflowBufferToPool will zero out and return small capacity buffers to a sync.Pool
-func ReleaseOverflowBufferToPool(ob *OverflowBuffer) {
-	if cap(ob.buf) > 2048 {
-		return
-	}
-	ob.buf = ob.buf[:0]
-	ob.nwrote = 0
-	ob.nread = 0
-	ob.f = nil
-	freeOverflowBuffers.Put(ob)
-	ob.eof = false
-	ob.fileWasResetForRead = false
-	ob.readCalled = false
+	// pastEnd is how far Seek has moved the position beyond the end of a buffer without a file
+	pastEnd int64
+	// pooled is 1 from when the buffer is released to an OverflowBufferPool until Get returns it, and is accessed
+	// atomically
+	pooled int32
 }
 
 // Read implements io.Reader. After calling Read, subsequent calls to Write will return an error
@@ -87,11 +86,264 @@ func (ob *OverflowBuffer) Read(p []byte) (nread int, err error) {
 	return
 }
 
-// Write implements io.Writer. Calling Write after a call to Read will return an Error
+// ReadAt implements io.ReaderAt. ReadAt does not affect the position from which Read reads and may be called from
+// multiple goroutines at once, but not at the same time as Write.
+func (ob *OverflowBuffer) ReadAt(p []byte, off int64) (nread int, err error) {
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("OverflowBuffer.ReadAt: %s", err)
+		}
+	}()
+
+	if off < 0 {
+		err = errors.New("negative offset")
+		return
+	}
+
+	if off < int64(len(ob.buf)) {
+		nread = copy(p, ob.buf[off:])
+	}
+
+	if len(p) > nread {
+		if ob.f == nil {
+			err = io.EOF
+			return
+		}
+		var n int
+		n, err = ob.f.ReadAt(p[nread:], off+int64(nread)-int64(len(ob.buf)))
+		nread += n
+	}
+
+	return
+}
+
+// Rewind resets the buffer so that its content can be read again from the beginning, as Seek(0, io.SeekStart) does.
+// As with Read, subsequent calls to Write will return an error.
+func (ob *OverflowBuffer) Rewind() {
+	// seeking to a position in memory can't fail
+	ob.Seek(0, io.SeekStart)
+}
+
+// WriteTo implements io.WriterTo, writing the unread content of the buffer to w. The part of the content that has
+// overflowed to disk is copied from the backing file with io.Copy, so that the operating system can transfer it
+// directly when w is, for example, a TCP connection and the backing file is a plain temporary file, as it is with
+// TempFileSpiller when the buffer isn't encrypted or compressed. As with Read, subsequent calls to Write will return an
+// error.
+func (ob *OverflowBuffer) WriteTo(w io.Writer) (nwrote int64, err error) {
+	ob.readCalled = true
+	if ob.eof {
+		return
+	}
+
+	n, err := w.Write(ob.buf[ob.nread:])
+	ob.nread += n
+	nwrote = int64(n)
+	if err != nil {
+		return
+	}
+
+	if ob.f != nil {
+		if !ob.fileWasResetForRead {
+			ob.fileWasResetForRead = true
+			if _, err = ob.f.Seek(0, io.SeekStart); err != nil {
+				err = fmt.Errorf("OverflowBuffer.WriteTo: %s", err)
+				return
+			}
+		}
+		var m int64
+		m, err = io.Copy(w, ob.f)
+		nwrote += m
+		if err != nil {
+			return
+		}
+	}
+	ob.eof = true
+	return
+}
+
+// ReadFrom implements io.ReaderFrom, writing the content read from r to the buffer until r returns io.EOF. Once the
+// capacity has been reached the remainder is copied to the backing file with io.Copy, so that the operating system
+// can transfer it directly when r is, for example, a TCP connection or another file and the backing file is a plain
+// temporary file, as with WriteTo. As with Write, calling ReadFrom after a call to Read will return an error.
+func (ob *OverflowBuffer) ReadFrom(r io.Reader) (nread int64, err error) {
+	if ob.readCalled {
+		err = errors.New("OverflowBuffer.ReadFrom: ReadFrom called after Read")
+		return
+	}
+	if ob.Budget != nil || ob.MaxSize > 0 {
+		// everything is written with Write so that it is accounted for
+		return io.Copy(struct{ io.Writer }{ob}, r)
+	}
+
+	for ob.nwrote < ob.Capacity {
+		if len(ob.buf) == cap(ob.buf) {
+			c := 2 * cap(ob.buf)
+			if c < 512 {
+				c = 512
+			}
+			if c > ob.Capacity {
+				c = ob.Capacity
+			}
+			buf := make([]byte, len(ob.buf), c)
+			copy(buf, ob.buf)
+			ob.buf = buf
+		}
+		n, rerr := r.Read(ob.buf[len(ob.buf):cap(ob.buf)])
+		ob.buf = ob.buf[:len(ob.buf)+n]
+		ob.nwrote += n
+		ob.size += int64(n)
+		nread += int64(n)
+		if rerr == io.EOF {
+			return
+		}
+		if rerr != nil {
+			err = rerr
+			return
+		}
+	}
+
+	// the backing file is only created if there is something to overflow
+	var probe [512]byte
+	n, err := io.ReadAtLeast(r, probe[:], 1)
+	if err == io.EOF {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if _, err = ob.Write(probe[:n]); err != nil {
+		return
+	}
+	nread += int64(n)
+
+	// errors are returned as is, since they are likely to come from r
+	m, err := io.Copy(ob.f, r)
+	ob.size += m
+	nread += m
+	return
+}
+
+// Seek implements io.Seeker, setting the position from which Read reads. Offsets relative to io.SeekEnd are relative
+// to the number of bytes that have been written. Seeking beyond the end is allowed, after which Read reads nothing. As
+// with Read, subsequent calls to Write will return an error.
+func (ob *OverflowBuffer) Seek(offset int64, whence int) (pos int64, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("OverflowBuffer.Seek: %s", err)
+		}
+	}()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		var cur int64
+		if cur, err = ob.position(); err != nil {
+			return
+		}
+		offset += cur
+	case io.SeekEnd:
+		offset += ob.size
+	default:
+		err = errors.New("invalid whence")
+		return
+	}
+	if offset < 0 {
+		err = errors.New("negative position")
+		return
+	}
+
+	ob.readCalled = true
+	ob.eof = false
+	ob.pastEnd = 0
+	if offset <= int64(len(ob.buf)) || ob.f == nil {
+		// positions beyond the end of a buffer without a file are kept, but read from as the end
+		ob.nread = len(ob.buf)
+		if offset < int64(len(ob.buf)) {
+			ob.nread = int(offset)
+		} else {
+			ob.pastEnd = offset - int64(len(ob.buf))
+		}
+		ob.fileWasResetForRead = false
+		return offset, nil
+	}
+
+	ob.nread = len(ob.buf)
+	if _, err = ob.f.Seek(offset-int64(len(ob.buf)), io.SeekStart); err != nil {
+		return
+	}
+	ob.fileWasResetForRead = true
+	return offset, nil
+}
+
+// position returns the position from which Read reads
+func (ob *OverflowBuffer) position() (int64, error) {
+	if !ob.fileWasResetForRead {
+		return int64(ob.nread) + ob.pastEnd, nil
+	}
+	off, err := ob.f.Seek(0, io.SeekCurrent)
+	return int64(len(ob.buf)) + off, err
+}
+
+// Size returns the total number of bytes that have been written to the buffer
+func (ob *OverflowBuffer) Size() int64 {
+	return ob.size
+}
+
+// Len returns the number of bytes that remain to be read
+func (ob *OverflowBuffer) Len() int64 {
+	pos, err := ob.position()
+	if err != nil || pos > ob.size {
+		return 0
+	}
+	return ob.size - pos
+}
+
+// Spilled reports whether the capacity has been exceeded, causing the buffer to overflow to disk
+func (ob *OverflowBuffer) Spilled() bool {
+	return ob.f != nil
+}
+
+// SpillPath returns the name of the backing file, or the empty string if the buffer hasn't spilled
+func (ob *OverflowBuffer) SpillPath() string {
+	if ob.f == nil {
+		return ""
+	}
+	return ob.f.Name()
+}
+
+// SpillSize returns the number of bytes that have overflowed to disk, raw, and the number of bytes that they take up
+// in the backing file, stored, which is smaller than raw when the buffer is compressed. The buffer's Budget is charged
+// raw. When the buffer is compressed or encrypted the content is stored in chunks, and the last chunk is held in
+// memory, uncounted by stored, until it is complete.
+func (ob *OverflowBuffer) SpillSize() (raw, stored int64) {
+	if ob.f == nil {
+		return 0, 0
+	}
+	raw = ob.size - int64(len(ob.buf))
+	if cf, ok := ob.f.(*chunkedFile); ok {
+		return raw, cf.stored()
+	}
+	return raw, raw
+}
+
+// Bytes returns the unread content of the buffer if it is all held in memory, in which case ok is true. The returned
+// slice aliases the buffer's memory, so it is only valid until the next call to a method that modifies the buffer.
+func (ob *OverflowBuffer) Bytes() (b []byte, ok bool) {
+	if ob.f != nil {
+		return nil, false
+	}
+	return ob.buf[ob.nread:], true
+}
+
+// Write implements io.Writer. Calling Write after a call to Read will return an Error. If writing p would exceed
+// MaxSize, nothing is written and the error wraps ErrTooLarge. If writing would exceed the disk limit of the buffer's
+// Budget, nothing is written to disk and the error wraps ErrBudgetExceeded.
 func (ob *OverflowBuffer) Write(p []byte) (nwrote int, err error) {
 	defer func() {
+		ob.size += int64(nwrote)
 		if err != nil {
-			err = fmt.Errorf("OverflowBuffer.Write: %s", err)
+			err = fmt.Errorf("OverflowBuffer.Write: %w", err)
 		}
 	}()
 
@@ -99,25 +351,52 @@ func (ob *OverflowBuffer) Write(p []byte) (nwrote int, err error) {
 		err = errors.New("Write called after Read")
 		return
 	}
+	if ob.MaxSize > 0 && ob.size+int64(len(p)) > ob.MaxSize {
+		err = ErrTooLarge
+		return
+	}
 
-	nwrote = ob.Capacity - ob.nwrote
-	if nwrote > len(p) {
-		nwrote = len(p)
+	// once the buffer has overflowed the rest of the content goes to disk, even if a Budget would now allow more memory
+	if ob.f == nil {
+		nwrote = ob.Capacity - ob.nwrote
+		if nwrote > len(p) {
+			nwrote = len(p)
+		}
+		if ob.Budget != nil {
+			nwrote = ob.Budget.reserveMemory(nwrote)
+			ob.memReserved += int64(nwrote)
+		}
 	}
 
 	ob.buf = append(ob.buf, p[:nwrote]...)
 	ob.nwrote += nwrote
 
 	if len(p) > nwrote {
+		rest := int64(len(p) - nwrote)
+		if ob.Budget != nil {
+			if !ob.Budget.reserveDisk(rest) {
+				err = ErrBudgetExceeded
+				return
+			}
+			ob.diskReserved += rest
+		}
 		if ob.f == nil {
-			ob.f, err = ioutil.TempFile(ob.Dir, ob.Prefix)
+			ob.f, err = ob.createFile()
 			if err != nil {
+				ob.releaseDisk(rest)
 				return
 			}
+			if ob.Budget != nil {
+				ob.Budget.spilled()
+			}
+			if ob.OnSpill != nil {
+				ob.OnSpill(ob)
+			}
 		}
 		var n int
 		n, err = ob.f.Write(p[nwrote:])
 		nwrote += n
+		ob.releaseDisk(rest - int64(n))
 	}
 
 	return
@@ -126,8 +405,58 @@ func (ob *OverflowBuffer) Write(p []byte) (nwrote int, err error) {
 // Close implements io.Closer. Calling Close will remove any backing file that was created as a result of overflowing the capacity.
 func (ob *OverflowBuffer) Close() (err error) {
 	if ob.f != nil {
-		ob.f.Close()
-		err = os.Remove(ob.f.Name())
+		err = ob.f.Remove()
+	}
+	if ob.Budget != nil {
+		ob.Budget.release(ob.memReserved, ob.diskReserved)
+		ob.memReserved, ob.diskReserved = 0, 0
 	}
 	return
 }
+
+// createFile creates the backing file
+func (ob *OverflowBuffer) createFile() (SpillFile, error) {
+	spiller := ob.Spiller
+	if spiller == nil {
+		spiller = TempFileSpiller{}
+	}
+	f, err := spiller.Spill(ob.Dir, ob.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !ob.Encrypt && !ob.Compress {
+		return f, nil
+	}
+
+	// chunks are compressed before they are encrypted, since encrypted data doesn't compress
+	var codecs []chunkCodec
+	if ob.Compress {
+		level := ob.CompressionLevel
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		fc, err := newFlateCodec(level)
+		if err != nil {
+			f.Remove()
+			return nil, err
+		}
+		codecs = append(codecs, fc)
+	}
+	if ob.Encrypt {
+		gc, err := newGCMCodec()
+		if err != nil {
+			f.Remove()
+			return nil, err
+		}
+		codecs = append(codecs, gc)
+	}
+	return newChunkedFile(f, codecs...), nil
+}
+
+// releaseDisk returns n bytes of disk space that were drawn from the Budget but not used
+func (ob *OverflowBuffer) releaseDisk(n int64) {
+	if ob.Budget != nil && n > 0 {
+		ob.Budget.release(0, n)
+		ob.diskReserved -= n
+	}
+}
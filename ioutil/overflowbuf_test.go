@@ -2,11 +2,17 @@ package ioutil
 
 import (
 	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"testing"
+	"testing/iotest"
 )
 
 func check(t *testing.T, testName string, ob *OverflowBuffer, pp []byte) {
@@ -87,7 +93,7 @@ func TestReleaseOverflowBufferToPool(t *testing.T) {
 		buf:    make([]byte, 100, 100),
 		nwrote: 100,
 		nread:  100,
-		f:      fWrite,
+		f:      tempFile{fWrite},
 		eof:    true,
 	}
 
@@ -234,3 +240,462 @@ func TestOverflowBufferZeroLengthRead(t *testing.T) {
 		}
 	}
 }
+
+func TestOverflowBufferRewind(t *testing.T) {
+	tests := []int{0, 4, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferRewind loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: capacity}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+		check(t, testName+" (1)", ob, r)
+		ob.Rewind()
+		check(t, testName+" (2)", ob, r)
+
+		// rewinding part way through
+		p := make([]byte, 7)
+		ob.Rewind()
+		ob.Read(p)
+		ob.Rewind()
+		check(t, testName+" (3)", ob, r)
+
+		if _, err := ob.Write(r); err == nil {
+			t.Error(testName + " (4): expected err to be non nil")
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferReadAt(t *testing.T) {
+	tests := []int{0, 4, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferReadAt loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: capacity}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+
+		for _, off := range []int{0, 3, 9, 20, 39} {
+			p := make([]byte, 8)
+			n, err := ob.ReadAt(p, int64(off))
+			expected := r[off:]
+			if len(expected) > len(p) {
+				expected = expected[:len(p)]
+			} else if err != io.EOF {
+				t.Errorf(testName+" (1): expected err to be io.EOF reading at %d, got %v", off, err)
+			}
+			if bytes.Compare(expected, p[:n]) != 0 {
+				t.Errorf(testName+" (2): expected to read %s at %d, got %s", expected, off, p[:n])
+			}
+		}
+
+		// ReadAt doesn't affect Read
+		check(t, testName+" (3)", ob, r)
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferSize(t *testing.T) {
+	tests := []int{0, 4, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferSize loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: capacity}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+		if expected, actual := int64(len(r)), ob.Size(); expected != actual {
+			t.Errorf(testName+" (1): expected size to be %d, got %d", expected, actual)
+		}
+
+		// reading doesn't affect the size
+		check(t, testName+" (2)", ob, r)
+		if expected, actual := int64(len(r)), ob.Size(); expected != actual {
+			t.Errorf(testName+" (3): expected size to be %d, got %d", expected, actual)
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferSeek(t *testing.T) {
+	tests := []int{0, 4, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferSeek loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: capacity}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+
+		for _, seek := range []struct {
+			offset   int64
+			whence   int
+			expected int64
+		}{
+			{3, io.SeekStart, 3},
+			{6, io.SeekCurrent, 13},
+			{-5, io.SeekEnd, 35},
+			{-30, io.SeekCurrent, 9},
+			{0, io.SeekEnd, 40},
+			{0, io.SeekStart, 0},
+		} {
+			pos, err := ob.Seek(seek.offset, seek.whence)
+			if err != nil {
+				t.Fatalf(testName+" (1): expected err to be nil, got %s", err)
+			}
+			if pos != seek.expected {
+				t.Errorf(testName+" (2): expected position to be %d, got %d", seek.expected, pos)
+			}
+			// reading moves the position along for the next relative seek
+			p := make([]byte, 4)
+			n, _ := ob.Read(p)
+			expected := r[pos:]
+			if len(expected) > len(p) {
+				expected = expected[:len(p)]
+			}
+			if bytes.Compare(expected, p[:n]) != 0 {
+				t.Errorf(testName+" (3): expected to read %s at %d, got %s", expected, pos, p[:n])
+			}
+		}
+
+		if _, err := ob.Seek(-1, io.SeekStart); err == nil {
+			t.Error(testName + " (4): expected err to be non nil")
+		}
+		if _, err := ob.Write(r); err == nil {
+			t.Error(testName + " (5): expected err to be non nil")
+		}
+
+		// a position beyond the end is kept, whether or not the buffer has spilled
+		if _, err := ob.Seek(10, io.SeekEnd); err != nil {
+			t.Fatalf(testName+" (6): expected err to be nil, got %s", err)
+		}
+		if pos, err := ob.Seek(0, io.SeekCurrent); err != nil || pos != 50 {
+			t.Errorf(testName+" (7): expected position to be 50, got %d (%v)", pos, err)
+		}
+		if n, _ := ob.Read(make([]byte, 4)); n != 0 {
+			t.Errorf(testName+" (8): expected to read nothing beyond the end, got %d bytes", n)
+		}
+		if n := ob.Len(); n != 0 {
+			t.Errorf(testName+" (9): expected Len to be 0, got %d", n)
+		}
+
+		// ReadAt doesn't depend on the position and Rewind returns to the start from any position
+		p := make([]byte, 5)
+		if n, err := ob.ReadAt(p, 35); n != 5 || err != nil || !bytes.Equal(p, r[35:]) {
+			t.Errorf(testName+" (10): expected to read %s at 35, got %s (%v)", r[35:], p[:n], err)
+		}
+		ob.Rewind()
+		if pos, err := ob.Seek(0, io.SeekCurrent); err != nil || pos != 0 {
+			t.Errorf(testName+" (11): expected Rewind to return to 0, got %d (%v)", pos, err)
+		}
+		check(t, testName+" (12)", ob, r)
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferWriteToReadFrom(t *testing.T) {
+	tests := []int{0, 4, 10, 40, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferWriteToReadFrom loop (%d)", i)
+		r := bytes.Repeat([]byte("abcdefgh"), 5)
+
+		ob := &OverflowBuffer{Capacity: capacity}
+		n, err := ob.ReadFrom(iotest.OneByteReader(bytes.NewReader(r)))
+		if err != nil {
+			t.Errorf(testName+" (1): expected err to be nil, got %s", err)
+		}
+		if n != int64(len(r)) || ob.Size() != int64(len(r)) {
+			t.Errorf(testName+" (2): expected to read %d bytes, got %d with size %d", len(r), n, ob.Size())
+		}
+		if (ob.f != nil) != (capacity < len(r)) {
+			t.Error(testName + " (3): expected a backing file only when the capacity is exceeded")
+		}
+
+		// part of the content is read before the rest is written
+		p := make([]byte, 3)
+		ob.Read(p)
+		var buf bytes.Buffer
+		n, err = ob.WriteTo(&buf)
+		if err != nil {
+			t.Errorf(testName+" (4): expected err to be nil, got %s", err)
+		}
+		if n != int64(len(r)-3) || bytes.Compare(r[3:], buf.Bytes()) != 0 {
+			t.Errorf(testName+" (5): expected to write %s, got %s", r[3:], buf.Bytes())
+		}
+		if n, _ := ob.WriteTo(&buf); n != 0 {
+			t.Errorf(testName+" (6): expected nothing to be written once the content has been read, got %d bytes", n)
+		}
+		if _, err := ob.ReadFrom(bytes.NewReader(r)); err == nil {
+			t.Error(testName + " (7): expected err to be non nil")
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+var benchmarkSize = flag.Int64("overflowbuf.size", 64<<20, "size of the payload used by OverflowBuffer benchmarks")
+
+// discardServer returns a TCP connection to a server that discards everything it receives
+func discardServer(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func benchmarkCopyToTCP(b *testing.B, hideWriterTo bool) {
+	ob := &OverflowBuffer{Capacity: 1 << 20}
+	defer ob.Close()
+	if _, err := io.CopyN(ob, rand.New(rand.NewSource(1)), *benchmarkSize); err != nil {
+		b.Fatal(err)
+	}
+	c := discardServer(b)
+	defer c.Close()
+
+	b.SetBytes(*benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.Rewind()
+		var src io.Reader = ob
+		if hideWriterTo {
+			src = struct{ io.Reader }{ob}
+		}
+		if _, err := io.Copy(c, src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Run with -overflowbuf.size to benchmark larger payloads, e.g. -overflowbuf.size=4294967296
+func BenchmarkOverflowBufferWriteToTCP(b *testing.B) { benchmarkCopyToTCP(b, false) }
+
+func BenchmarkOverflowBufferReadToTCP(b *testing.B) { benchmarkCopyToTCP(b, true) }
+
+func benchmarkCopyFromFile(b *testing.B, hideReaderFrom bool) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(1)), *benchmarkSize); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(*benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Seek(0, io.SeekStart)
+		ob := &OverflowBuffer{Capacity: 1 << 20}
+		var dst io.Writer = ob
+		if hideReaderFrom {
+			dst = struct{ io.Writer }{ob}
+		}
+		if _, err := io.Copy(dst, f); err != nil {
+			b.Fatal(err)
+		}
+		ob.Close()
+	}
+}
+
+func BenchmarkOverflowBufferReadFromFile(b *testing.B) { benchmarkCopyFromFile(b, false) }
+
+func BenchmarkOverflowBufferWriteFromFile(b *testing.B) { benchmarkCopyFromFile(b, true) }
+
+func TestOverflowBufferIntrospection(t *testing.T) {
+	tests := []int{0, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferIntrospection loop (%d)", i)
+
+		var spilled []string
+		ob := &OverflowBuffer{Capacity: capacity, OnSpill: func(ob *OverflowBuffer) {
+			spilled = append(spilled, ob.SpillPath())
+		}}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+
+		expectSpill := capacity < len(r)
+		if ob.Spilled() != expectSpill {
+			t.Errorf(testName+" (1): expected Spilled to be %t", expectSpill)
+		}
+		if expectSpill && (len(spilled) != 1 || spilled[0] == "" || spilled[0] != ob.SpillPath()) {
+			t.Errorf(testName+" (2): expected OnSpill to be called once with the backing file, got %v", spilled)
+		}
+		if !expectSpill && (len(spilled) != 0 || ob.SpillPath() != "") {
+			t.Errorf(testName+" (3): expected no backing file, got %v", spilled)
+		}
+
+		b, ok := ob.Bytes()
+		if ok == expectSpill {
+			t.Errorf(testName+" (4): expected Bytes to be available only in memory, got %t", ok)
+		}
+		if ok && bytes.Compare(r, b) != 0 {
+			t.Errorf(testName+" (5): expected Bytes to be %s, got %s", r, b)
+		}
+
+		if expected, actual := int64(len(r)), ob.Len(); expected != actual {
+			t.Errorf(testName+" (6): expected Len to be %d, got %d", expected, actual)
+		}
+		ob.Read(make([]byte, 15))
+		if expected, actual := int64(len(r)-15), ob.Len(); expected != actual {
+			t.Errorf(testName+" (7): expected Len to be %d, got %d", expected, actual)
+		}
+		if b, ok := ob.Bytes(); ok && bytes.Compare(r[15:], b) != 0 {
+			t.Errorf(testName+" (8): expected Bytes to be %s, got %s", r[15:], b)
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferMaxSize(t *testing.T) {
+	tests := []int{0, 10, 100}
+
+	for i, capacity := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferMaxSize loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: capacity, MaxSize: 40}
+		r := fill(t, testName, ob, []byte("abcdefgh"), 5)
+
+		if n, err := ob.Write([]byte("x")); n != 0 || !errors.Is(err, ErrTooLarge) {
+			t.Errorf(testName+" (1): expected ErrTooLarge with nothing written, got %d and %v", n, err)
+		}
+		check(t, testName+" (2)", ob, r)
+		cleanup(t, testName, ob)
+
+		ob = &OverflowBuffer{Capacity: capacity, MaxSize: 40}
+		if _, err := ob.ReadFrom(bytes.NewReader(bytes.Repeat(r, 2))); !errors.Is(err, ErrTooLarge) {
+			t.Errorf(testName+" (3): expected ErrTooLarge, got %v", err)
+		}
+		if ob.Size() > 40 {
+			t.Errorf(testName+" (4): expected at most 40 bytes to be held, got %d", ob.Size())
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferEncrypt(t *testing.T) {
+	tests := []struct {
+		capacity, size int
+	}{
+		{0, 100},
+		{100, spillChunkSize},
+		{1000, 3*spillChunkSize + 123},
+	}
+
+	for i, test := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferEncrypt loop (%d)", i)
+		p := make([]byte, test.size)
+		rand.Read(p)
+
+		ob := &OverflowBuffer{Capacity: test.capacity, Encrypt: true}
+		r := fill(t, testName, ob, p, 2)
+		if !ob.Spilled() {
+			t.Fatal(testName + " (1): expected the buffer to have spilled")
+		}
+
+		onDisk, err := ioutil.ReadFile(ob.SpillPath())
+		if err != nil {
+			t.Fatalf(testName+" (2): err should be nil, found err == %s", err)
+		}
+		sample := r[test.capacity:]
+		if len(sample) > 32 {
+			sample = sample[:32]
+		}
+		if bytes.Contains(onDisk, sample) {
+			t.Error(testName + " (3): expected the content not to be written to disk in plaintext")
+		}
+
+		b := make([]byte, 50)
+		off := int64(len(r) - 60)
+		if n, err := ob.ReadAt(b, off); n != len(b) || err != nil || !bytes.Equal(b, r[off:off+50]) {
+			t.Errorf(testName+" (4): expected to read %d bytes at %d, got %d and err == %v", len(b), off, n, err)
+		}
+
+		if _, err := ob.Seek(int64(test.capacity+5), io.SeekStart); err != nil {
+			t.Errorf(testName+" (5): err should be nil, found err == %s", err)
+		}
+		check(t, testName+" (6)", ob, r[test.capacity+5:])
+
+		ob.Rewind()
+		var w bytes.Buffer
+		if n, err := ob.WriteTo(&w); n != int64(len(r)) || err != nil || !bytes.Equal(w.Bytes(), r) {
+			t.Errorf(testName+" (7): expected to write %d bytes, got %d and err == %v", len(r), n, err)
+		}
+		cleanup(t, testName, ob)
+	}
+}
+
+func TestOverflowBufferEncryptTampered(t *testing.T) {
+	testName := "TestOverflowBufferEncryptTampered"
+	ob := &OverflowBuffer{Encrypt: true}
+	fill(t, testName, ob, make([]byte, spillChunkSize), 1)
+
+	f, err := os.OpenFile(ob.SpillPath(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf(testName+" (1): err should be nil, found err == %s", err)
+	}
+	f.WriteAt([]byte{1}, 10)
+	f.Close()
+
+	if _, err := ioutil.ReadAll(ob); err == nil {
+		t.Error(testName + " (2): expected reading modified content to fail")
+	}
+	cleanup(t, testName, ob)
+}
+
+func TestOverflowBufferCompress(t *testing.T) {
+	tests := []struct {
+		capacity, level int
+		encrypt         bool
+	}{
+		{0, 0, false},
+		{100, flate.BestSpeed, false},
+		{1000, flate.BestCompression, true},
+	}
+
+	line := []byte(`{"id":12345,"name":"a fairly repetitive record","tags":["json","csv"]}` + "\n")
+	for i, test := range tests {
+		testName := fmt.Sprintf("TestOverflowBufferCompress loop (%d)", i)
+		budget := &Budget{}
+		ob := &OverflowBuffer{Capacity: test.capacity, Compress: true, CompressionLevel: test.level, Encrypt: test.encrypt, Budget: budget}
+		r := fill(t, testName, ob, line, 5000)
+
+		raw, stored := ob.SpillSize()
+		if e := int64(len(r) - test.capacity); raw != e {
+			t.Errorf(testName+" (1): expected %d raw bytes, got %d", e, raw)
+		}
+		fi, err := os.Stat(ob.SpillPath())
+		if err != nil {
+			t.Fatalf(testName+" (2): err should be nil, found err == %s", err)
+		}
+		if stored != fi.Size() || stored == 0 || stored > raw/4 {
+			t.Errorf(testName+" (3): expected %d stored bytes, a fraction of %d, got %d", fi.Size(), raw, stored)
+		}
+		// the disk space drawn from the budget is counted in raw bytes
+		if used := budget.Stats().DiskUsed; used != raw {
+			t.Errorf(testName+" (4): expected the budget to count %d bytes on disk, got %d", raw, used)
+		}
+
+		b := make([]byte, 100)
+		off := int64(3*spillChunkSize - 50)
+		if n, err := ob.ReadAt(b, off); n != len(b) || err != nil || !bytes.Equal(b, r[off:off+100]) {
+			t.Errorf(testName+" (5): expected to read %d bytes at %d, got %d and err == %v", len(b), off, n, err)
+		}
+		check(t, testName+" (6)", ob, r)
+		cleanup(t, testName, ob)
+	}
+
+	ob := &OverflowBuffer{Compress: true, CompressionLevel: 42}
+	if _, err := ob.Write(line); err == nil {
+		t.Error("TestOverflowBufferCompress (7): expected an invalid compression level to fail")
+	}
+	ob.Close()
+}
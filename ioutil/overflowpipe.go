@@ -0,0 +1,250 @@
+package ioutil
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// OverflowPipe is an in-order pipe between a writer and a reader in different goroutines, which never blocks the
+// writer. Up to Capacity unread bytes are held in memory; when the reader falls further behind than that, what is
+// written is spilled to a file until the reader catches up. Reads block until there is something to read or the
+// writer has closed the pipe.
+//
+// Spill files are the backing files of OverflowBuffers, which are created, encrypted, compressed and drawn from a
+// Budget as those of an OverflowBuffer with the same settings would be. The memory held by the pipe is drawn from the
+// Budget too. Files are written and read without holding the pipe's lock, so neither end waits for the other's disk
+// I/O. Once the reader has read everything that was in memory, the writer moves on to a new file and the reader reads
+// the one it was writing, which is removed when the reader has caught up with it.
+//
+// The writer must call Close or CloseWithError when finished. The reader must either read until Read returns an error
+// or call CloseRead, which is when the spill files are removed.
+type OverflowPipe struct {
+	// Capacity is the number of unread bytes that the pipe will hold in memory before writing to disk
+	Capacity int
+	// Dir, Prefix, Spiller, Budget, Encrypt, Compress and CompressionLevel configure the spill files as they do the
+	// backing file of an OverflowBuffer
+	Dir, Prefix      string
+	Spiller          Spiller
+	Budget           *Budget
+	Encrypt          bool
+	Compress         bool
+	CompressionLevel int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// buf[r:] is the unread part of the stream that is held in memory, which always precedes the part in the files
+	buf         []byte
+	r           int
+	memReserved int64
+	// rf holds the unread part of the file being read, which is followed by the wsize bytes in wf, the file being
+	// written. Each is only used by its end of the pipe while reading or writing is true, without holding mu.
+	rf, wf           *OverflowBuffer
+	wsize            int64
+	reading, writing bool
+	wclosed, rclosed bool
+	werr             error
+}
+
+func (p *OverflowPipe) init() {
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+	}
+}
+
+// spilled reports whether part of the unread stream is in a file, in which case what is written must follow it
+func (p *OverflowPipe) spilled() bool {
+	return p.rf != nil || p.wf != nil
+}
+
+// Write implements io.Writer. Write returns io.ErrClosedPipe if either end of the pipe has been closed.
+func (p *OverflowPipe) Write(b []byte) (nwrote int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	defer func() {
+		p.cond.Broadcast()
+		if err != nil && err != io.ErrClosedPipe {
+			err = fmt.Errorf("OverflowPipe.Write: %w", err)
+		}
+	}()
+
+	for p.writing {
+		p.cond.Wait()
+	}
+	if p.wclosed || p.rclosed {
+		err = io.ErrClosedPipe
+		return
+	}
+
+	// once the stream has spilled, it continues in the files until the reader has caught up
+	if n := p.Capacity - (len(p.buf) - p.r); !p.spilled() && n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		if p.Budget != nil {
+			n = p.Budget.reserveMemory(n)
+			p.memReserved += int64(n)
+		}
+		p.compact(n)
+		p.buf = append(p.buf, b[:n]...)
+		nwrote = n
+	}
+
+	if len(b) > nwrote {
+		if p.wf == nil {
+			p.wf = &OverflowBuffer{
+				Dir:              p.Dir,
+				Prefix:           p.Prefix,
+				Spiller:          p.Spiller,
+				Budget:           p.Budget,
+				Encrypt:          p.Encrypt,
+				Compress:         p.Compress,
+				CompressionLevel: p.CompressionLevel,
+			}
+		}
+		f := p.wf
+		p.writing = true
+		p.mu.Unlock()
+		var n int
+		n, err = f.Write(b[nwrote:])
+		p.mu.Lock()
+		p.writing = false
+
+		p.wsize += int64(n)
+		nwrote += n
+		if p.rclosed {
+			p.wf, p.wsize = nil, 0
+			f.Close()
+		}
+	}
+	return
+}
+
+// compact moves the unread part of buf to its start if that is needed to make room for n more bytes
+func (p *OverflowPipe) compact(n int) {
+	if p.r > 0 && len(p.buf)+n > cap(p.buf) {
+		p.buf = p.buf[:copy(p.buf, p.buf[p.r:])]
+		p.r = 0
+	}
+}
+
+// Read implements io.Reader. Read blocks until there is something to read. Once the writer has closed the pipe and
+// everything has been read, Read returns io.EOF, or the error passed to CloseWithError.
+func (p *OverflowPipe) Read(b []byte) (nread int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	defer func() {
+		if err != nil && err != io.EOF && err != io.ErrClosedPipe && err != p.werr {
+			err = fmt.Errorf("OverflowPipe.Read: %w", err)
+		}
+	}()
+
+	if len(b) == 0 {
+		return
+	}
+	for {
+		switch {
+		case p.rclosed:
+			err = io.ErrClosedPipe
+			return
+		case p.r < len(p.buf):
+			nread = copy(b, p.buf[p.r:])
+			p.r += nread
+			if p.r == len(p.buf) {
+				p.buf, p.r = p.buf[:0], 0
+			}
+			p.releaseMemory(int64(nread))
+			return
+		case p.rf == nil && p.wf != nil && p.wsize > 0 && !p.writing:
+			// the reader has caught up with everything before the file being written, so it takes that file over
+			p.rf = p.wf
+			p.wf, p.wsize = nil, 0
+			continue
+		case p.rf != nil:
+			f := p.rf
+			p.reading = true
+			p.mu.Unlock()
+			nread, err = f.Read(b)
+			p.mu.Lock()
+			p.reading = false
+
+			if err == io.EOF || p.rclosed {
+				// the reader has caught up with the file, so it is removed
+				p.rf = nil
+				cerr := f.Close()
+				if err == io.EOF {
+					err = cerr
+				}
+				if nread == 0 && err == nil {
+					continue
+				}
+			}
+			return
+		case p.wclosed && !p.writing:
+			p.removeFiles()
+			err = p.werr
+			if err == nil {
+				err = io.EOF
+			}
+			return
+		}
+		p.cond.Wait()
+	}
+}
+
+// Close closes the writing end of the pipe. The reader will receive io.EOF once it has read everything that was written.
+func (p *OverflowPipe) Close() error {
+	return p.CloseWithError(nil)
+}
+
+// CloseWithError closes the writing end of the pipe. The reader will receive err, or io.EOF if err is nil, once it has
+// read everything that was written.
+func (p *OverflowPipe) CloseWithError(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	if !p.wclosed {
+		p.wclosed = true
+		p.werr = err
+	}
+	p.cond.Broadcast()
+	return nil
+}
+
+// CloseRead closes the reading end of the pipe, discarding anything that hasn't been read. Subsequent calls to Write
+// will return io.ErrClosedPipe.
+func (p *OverflowPipe) CloseRead() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	p.rclosed = true
+	p.buf, p.r = nil, 0
+	p.releaseMemory(p.memReserved)
+	p.cond.Broadcast()
+	return p.removeFiles()
+}
+
+// removeFiles removes the files that aren't being read or written. Those that are are removed once that is done.
+func (p *OverflowPipe) removeFiles() (err error) {
+	if p.rf != nil && !p.reading {
+		err = p.rf.Close()
+		p.rf = nil
+	}
+	if p.wf != nil && !p.writing {
+		if werr := p.wf.Close(); err == nil {
+			err = werr
+		}
+		p.wf, p.wsize = nil, 0
+	}
+	return
+}
+
+// releaseMemory returns n bytes of memory that were drawn from the Budget
+func (p *OverflowPipe) releaseMemory(n int64) {
+	if p.Budget != nil && n > 0 {
+		p.Budget.release(n, 0)
+		p.memReserved -= n
+	}
+}
@@ -0,0 +1,233 @@
+package ioutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOverflowPipe(t *testing.T) {
+	testName := "TestOverflowPipe"
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	// the writer never blocks, so the whole content can be written before anything is read
+	p := &OverflowPipe{Capacity: 1000}
+	for i := 0; i < len(content); i += 700 {
+		end := i + 700
+		if end > len(content) {
+			end = len(content)
+		}
+		if n, err := p.Write(content[i:end]); err != nil || n != end-i {
+			t.Errorf("%s (1): Expected to write %d bytes, wrote %d with err %v", testName, end-i, n, err)
+		}
+	}
+	var spill string
+	if p.wf != nil {
+		spill = p.wf.SpillPath()
+	}
+	p.Close()
+
+	if spill == "" {
+		t.Fatalf("%s (2): Expected the pipe to have spilled to disk", testName)
+	}
+	actual, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Errorf("%s (3): Expected err to be nil, got %s", testName, err)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Errorf("%s (4): Expected to read the content that was written, got %d bytes", testName, len(actual))
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Errorf("%s (5): Expected the spill file to have been removed, got %v", testName, err)
+	}
+}
+
+func TestOverflowPipeInterleaved(t *testing.T) {
+	testName := "TestOverflowPipeInterleaved"
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	// a reader that keeps falling behind and catching up moves the stream between memory and disk repeatedly
+	p := &OverflowPipe{Capacity: 500}
+	go func() {
+		r := rand.New(rand.NewSource(3))
+		for i := 0; i < len(content); {
+			end := i + r.Intn(2000)
+			if end > len(content) {
+				end = len(content)
+			}
+			p.Write(content[i:end])
+			i = end
+			if r.Intn(10) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		p.Close()
+	}()
+
+	var actual []byte
+	buf := make([]byte, 300)
+	for {
+		n, err := p.Read(buf)
+		actual = append(actual, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s (1): Expected err to be nil, got %s", testName, err)
+		}
+	}
+	if !bytes.Equal(content, actual) {
+		t.Errorf("%s (2): Expected to read the content that was written, got %d bytes", testName, len(actual))
+	}
+}
+
+func TestOverflowPipeReadBlocks(t *testing.T) {
+	testName := "TestOverflowPipeReadBlocks"
+
+	p := &OverflowPipe{Capacity: 10}
+	result := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(p)
+		result <- err
+	}()
+
+	select {
+	case <-result:
+		t.Fatalf("%s (1): Expected Read to block", testName)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	writeErr := errors.New("producer failed")
+	p.Write([]byte("some content"))
+	p.CloseWithError(writeErr)
+	if err := <-result; err != writeErr {
+		t.Errorf("%s (2): Expected err to be '%s', got %v", testName, writeErr, err)
+	}
+}
+
+func TestOverflowPipeCloseRead(t *testing.T) {
+	testName := "TestOverflowPipeCloseRead"
+
+	p := &OverflowPipe{Capacity: 4}
+	p.Write([]byte("some content"))
+	spill := p.wf.SpillPath()
+
+	if err := p.CloseRead(); err != nil {
+		t.Errorf("%s (1): Expected err to be nil, got %s", testName, err)
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Errorf("%s (2): Expected the spill file to have been removed, got %v", testName, err)
+	}
+	if _, err := p.Write([]byte("more content")); err != io.ErrClosedPipe {
+		t.Errorf("%s (3): Expected io.ErrClosedPipe, got %v", testName, err)
+	}
+	if _, err := p.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("%s (4): Expected io.ErrClosedPipe, got %v", testName, err)
+	}
+}
+
+func TestOverflowPipeSpiller(t *testing.T) {
+	testName := "TestOverflowPipeSpiller"
+
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	mem := &MemSpiller{}
+	budget := &Budget{Memory: 500}
+	p := &OverflowPipe{Capacity: 1000, Spiller: mem, Budget: budget, Encrypt: true}
+	if n, err := p.Write(content); err != nil || n != len(content) {
+		t.Errorf("%s (1): Expected to write %d bytes, wrote %d with err %v", testName, len(content), n, err)
+	}
+	p.Close()
+
+	// the budget's memory limit spills the pipe before its Capacity
+	stats := budget.Stats()
+	if stats.MemoryUsed != 500 || stats.DiskUsed != int64(len(content)-500) || stats.Spills != 1 {
+		t.Errorf("%s (2): Expected 500 bytes in memory and the rest on disk, got %+v", testName, stats)
+	}
+	if mem.Files() != 1 || mem.Used() == 0 {
+		t.Errorf("%s (3): Expected the pipe to spill to a file from the Spiller, got %d files", testName, mem.Files())
+	}
+
+	actual, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Errorf("%s (4): Expected err to be nil, got %s", testName, err)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Errorf("%s (5): Expected to read the content that was written, got %d bytes", testName, len(actual))
+	}
+	if stats := budget.Stats(); stats.MemoryUsed != 0 || stats.DiskUsed != 0 {
+		t.Errorf("%s (6): Expected the budget to have been returned, got %+v", testName, stats)
+	}
+	if n := mem.Files(); n != 0 {
+		t.Errorf("%s (7): Expected the spill files to have been removed, %d remain", testName, n)
+	}
+}
+
+// blockingSpiller creates files whose reads signal reading and block until release is closed
+type blockingSpiller struct {
+	MemSpiller
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSpiller) Spill(dir, prefix string) (SpillFile, error) {
+	f, err := s.MemSpiller.Spill(dir, prefix)
+	return &blockingFile{f, s}, err
+}
+
+type blockingFile struct {
+	SpillFile
+	s *blockingSpiller
+}
+
+func (f *blockingFile) Read(p []byte) (int, error) {
+	select {
+	case f.s.reading <- struct{}{}:
+	default:
+	}
+	<-f.s.release
+	return f.SpillFile.Read(p)
+}
+
+func TestOverflowPipeWriterDoesNotWait(t *testing.T) {
+	testName := "TestOverflowPipeWriterDoesNotWait"
+
+	s := &blockingSpiller{reading: make(chan struct{}, 1), release: make(chan struct{})}
+	p := &OverflowPipe{Capacity: 4, Spiller: s}
+	p.Write([]byte("some content"))
+
+	result := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(p)
+		result <- b
+	}()
+	<-s.reading
+
+	// the reader is stuck reading the spill file, which mustn't hold up the writer
+	written := make(chan struct{})
+	go func() {
+		p.Write([]byte(" and more content"))
+		p.Close()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatalf("%s (1): Expected Write not to wait for the reader", testName)
+	}
+
+	close(s.release)
+	if expected, actual := "some content and more content", string(<-result); expected != actual {
+		t.Errorf("%s (2): Expected to read '%s', got '%s'", testName, expected, actual)
+	}
+}
@@ -0,0 +1,160 @@
+package ioutil
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultMaxRetained is the largest memory buffer that an OverflowBufferPool retains when MaxRetained is zero
+	DefaultMaxRetained = 1 << 20
+	// minSizeClass is the capacity of the memory buffers in the smallest size class, which also holds smaller ones
+	minSizeClass = 512
+)
+
+var defaultOverflowBufferPool = &OverflowBufferPool{}
+
+// GetOverflowBufferFromPool returns an OverflowBuffer with the given Capacity, Dir and Prefix from a default
+// OverflowBufferPool
+func GetOverflowBufferFromPool(capacity int, dir, prefix string) *OverflowBuffer {
+	return defaultOverflowBufferPool.Get(capacity, dir, prefix)
+}
+
+// ReleaseOverflowBufferToPool closes and resets ob and returns it to the default OverflowBufferPool
+func ReleaseOverflowBufferToPool(ob *OverflowBuffer) {
+	defaultOverflowBufferPool.Release(ob)
+}
+
+// OverflowBufferPool is a pool of OverflowBuffers, which keeps their memory buffers for reuse. Buffers are pooled in
+// size classes, each twice the size of the previous one, by the capacity of their memory buffer, so that Get returns
+// a buffer whose memory suits the requested Capacity.
+//
+// An OverflowBufferPool may be used from multiple goroutines at once and must not be copied after first use.
+type OverflowBufferPool struct {
+	// MaxRetained is the capacity of the largest memory buffer that is retained. Larger buffers are discarded when they
+	// are released. If zero, DefaultMaxRetained is used.
+	MaxRetained int
+
+	once  sync.Once
+	max   int
+	pools []sync.Pool
+
+	hits, misses, releases, discards, doubleReleases int64
+}
+
+// OverflowBufferPoolStats counts what has happened in an OverflowBufferPool
+type OverflowBufferPoolStats struct {
+	// Hits and Misses count the calls to Get that did and didn't reuse a buffer
+	Hits, Misses int64
+	// Releases counts the buffers that were released and Discards those of them that weren't retained because they
+	// were too large
+	Releases, Discards int64
+	// DoubleReleases counts the calls to Release with a buffer that was already in the pool, which were ignored
+	DoubleReleases int64
+}
+
+func (p *OverflowBufferPool) init() {
+	p.once.Do(func() {
+		p.max = p.MaxRetained
+		if p.max <= 0 {
+			p.max = DefaultMaxRetained
+		}
+		p.pools = make([]sync.Pool, sizeClass(p.max)+1)
+	})
+}
+
+// sizeClass returns the index of the smallest size class whose buffers have a capacity of at least n
+func sizeClass(n int) int {
+	if n <= minSizeClass {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - bits.Len(minSizeClass-1)
+}
+
+// floorSizeClass returns the index of the largest size class whose buffers have a capacity of at most n, or 0 if
+// there is none
+func floorSizeClass(n int) int {
+	if n < 2*minSizeClass {
+		return 0
+	}
+	return bits.Len(uint(n)) - bits.Len(minSizeClass)
+}
+
+// Get returns an OverflowBuffer with the given Capacity, Dir and Prefix. A pooled buffer is reused if there is one in
+// the size class of capacity, whose memory buffer is at least that size but less than twice it, or else in a smaller
+// size class; otherwise a new buffer is returned.
+func (p *OverflowBufferPool) Get(capacity int, dir, prefix string) *OverflowBuffer {
+	p.init()
+	class := sizeClass(capacity)
+	if class >= len(p.pools) {
+		class = len(p.pools) - 1
+	}
+
+	var ob *OverflowBuffer
+	for ; class >= 0 && ob == nil; class-- {
+		ob, _ = p.pools[class].Get().(*OverflowBuffer)
+	}
+	if ob == nil {
+		atomic.AddInt64(&p.misses, 1)
+		ob = new(OverflowBuffer)
+	} else {
+		atomic.AddInt64(&p.hits, 1)
+		atomic.StoreInt32(&ob.pooled, 0)
+	}
+
+	ob.Capacity = capacity
+	ob.Dir = dir
+	ob.Prefix = prefix
+	return ob
+}
+
+// Release closes ob, removing any backing file and returning what it drew from its Budget, resets it and returns it
+// to the pool, unless its memory buffer is larger than MaxRetained. ob must not be used afterwards. Releasing a buffer
+// that has already been released is detected and ignored, but releasing a buffer that has since been returned by Get
+// again can't be.
+func (p *OverflowBufferPool) Release(ob *OverflowBuffer) {
+	p.init()
+	if !atomic.CompareAndSwapInt32(&ob.pooled, 0, 1) {
+		atomic.AddInt64(&p.doubleReleases, 1)
+		return
+	}
+	atomic.AddInt64(&p.releases, 1)
+	ob.Close()
+
+	// the buffer is reset before it is put in the pool, from which it may be taken at once by another goroutine
+	buf := ob.buf[:0]
+	if cap(buf) > p.max {
+		atomic.AddInt64(&p.discards, 1)
+		ob.reset(nil)
+		return
+	}
+	ob.reset(buf)
+	// buffers are filed under the largest size class that they fill, so that each class only hands out buffers at
+	// least as large as its size
+	p.pools[floorSizeClass(cap(buf))].Put(ob)
+}
+
+// reset sets every field of ob except pooled, which is accessed atomically, to its zero value and its memory buffer
+// to buf
+func (ob *OverflowBuffer) reset(buf []byte) {
+	ob.Capacity, ob.Dir, ob.Prefix = 0, "", ""
+	ob.Spiller, ob.OnSpill, ob.Budget, ob.MaxSize = nil, nil, nil, 0
+	ob.Encrypt, ob.Compress, ob.CompressionLevel = false, false, 0
+	ob.buf, ob.nwrote, ob.nread = buf, 0, 0
+	ob.size, ob.memReserved, ob.diskReserved = 0, 0, 0
+	ob.f = nil
+	ob.eof, ob.fileWasResetForRead, ob.readCalled = false, false, false
+	ob.pastEnd = 0
+}
+
+// Stats returns the counts of what has happened in p
+func (p *OverflowBufferPool) Stats() OverflowBufferPoolStats {
+	return OverflowBufferPoolStats{
+		Hits:           atomic.LoadInt64(&p.hits),
+		Misses:         atomic.LoadInt64(&p.misses),
+		Releases:       atomic.LoadInt64(&p.releases),
+		Discards:       atomic.LoadInt64(&p.discards),
+		DoubleReleases: atomic.LoadInt64(&p.doubleReleases),
+	}
+}
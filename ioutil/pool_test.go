@@ -0,0 +1,134 @@
+package ioutil
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSizeClass(t *testing.T) {
+	tests := []struct {
+		n, expected int
+	}{
+		{0, 0},
+		{512, 0},
+		{513, 1},
+		{1024, 1},
+		{1025, 2},
+		{1 << 20, 11},
+	}
+
+	for i, test := range tests {
+		if class := sizeClass(test.n); class != test.expected {
+			t.Errorf("TestSizeClass loop (%d): expected the size class of %d to be %d, got %d", i, test.n, test.expected, class)
+		}
+	}
+
+	floorTests := []struct {
+		n, expected int
+	}{
+		{0, 0},
+		{700, 0},
+		{1023, 0},
+		{1024, 1},
+		{2047, 1},
+		{1 << 20, 11},
+	}
+
+	for i, test := range floorTests {
+		if class := floorSizeClass(test.n); class != test.expected {
+			t.Errorf("TestSizeClass floor loop (%d): expected the floor size class of %d to be %d, got %d", i, test.n, test.expected, class)
+		}
+	}
+}
+
+func TestOverflowBufferPool(t *testing.T) {
+	testName := "TestOverflowBufferPool"
+	p := &OverflowBufferPool{MaxRetained: 64 << 10}
+
+	ob := p.Get(8<<10, "", "")
+	fill(t, testName, ob, make([]byte, 1000), 8)
+	ob.Close()
+	mem := cap(ob.buf)
+	p.Release(ob)
+	p.Release(ob)
+
+	if got := p.Get(512, "", ""); got == ob {
+		t.Error(testName + " (1): expected a buffer for a smaller size class not to reuse a larger memory buffer")
+	}
+	// sync.Pool may drop what it holds at any time, so a miss is possible
+	if got := p.Get(8<<10, "dir", "prefix"); got == ob {
+		if cap(got.buf) != mem || len(got.buf) != 0 || got.size != 0 || got.pooled != 0 {
+			t.Errorf(testName+" (2): expected a reset buffer with its memory, got cap == %d, len == %d, size == %d", cap(got.buf), len(got.buf), got.size)
+		}
+		if got.Capacity != 8<<10 || got.Dir != "dir" || got.Prefix != "prefix" {
+			t.Errorf(testName+" (3): expected the buffer to be configured, got %d, %q and %q", got.Capacity, got.Dir, got.Prefix)
+		}
+	}
+
+	large := p.Get(128<<10, "", "")
+	fill(t, testName, large, make([]byte, 1000), 100)
+	large.Close()
+	p.Release(large)
+	if large.buf != nil {
+		t.Error(testName + " (4): expected the memory of a buffer larger than MaxRetained to be discarded")
+	}
+
+	stats := p.Stats()
+	if stats.Hits+stats.Misses != 4 {
+		t.Errorf(testName+" (5): expected 4 gets, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+	if stats.Releases != 2 || stats.Discards != 1 || stats.DoubleReleases != 1 {
+		t.Errorf(testName+" (6): expected 2 releases, 1 discard and 1 double release, got %+v", stats)
+	}
+
+	// releasing a buffer closes it
+	budget := &Budget{}
+	spilled := p.Get(100, "", "")
+	spilled.Budget = budget
+	fill(t, testName, spilled, make([]byte, 100), 3)
+	path := spilled.SpillPath()
+	p.Release(spilled)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf(testName+" (7): expected the backing file to have been removed, found err == %v", err)
+	}
+	if stats := budget.Stats(); stats.MemoryUsed != 0 || stats.DiskUsed != 0 {
+		t.Errorf(testName+" (8): expected the budget to have been returned, got %+v", stats)
+	}
+	if expected := (OverflowBuffer{buf: spilled.buf, pooled: 1}); !reflect.DeepEqual(*spilled, expected) {
+		t.Errorf(testName+" (9): expected every field to be reset, got %+v", *spilled)
+	}
+
+	// a buffer is filed under the largest size class that it fills
+	small := &OverflowBuffer{buf: make([]byte, 0, 700)}
+	p.Release(small)
+	if got, _ := p.pools[sizeClass(1024)].Get().(*OverflowBuffer); got == small {
+		t.Error(testName + " (10): expected a buffer not to be filed under a size class larger than it")
+	}
+}
+
+func TestOverflowBufferPoolConcurrent(t *testing.T) {
+	p := &OverflowBufferPool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testName := fmt.Sprintf("TestOverflowBufferPoolConcurrent goroutine (%d)", i)
+			for j := 0; j < 100; j++ {
+				ob := p.Get(256<<(j%6), "", "")
+				r := fill(t, testName, ob, []byte("abcdefghij"), 20*(j%6))
+				check(t, testName, ob, r)
+				ob.Close()
+				p.Release(ob)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stats := p.Stats(); stats.Releases != 800 || stats.DoubleReleases != 0 {
+		t.Errorf("TestOverflowBufferPoolConcurrent: expected 800 releases, got %+v", stats)
+	}
+}
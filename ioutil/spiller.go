@@ -0,0 +1,182 @@
+package ioutil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Spiller creates the files to which OverflowBuffers overflow
+type Spiller interface {
+	// Spill creates an empty file. dir and prefix are the Dir and Prefix of the buffer.
+	Spill(dir, prefix string) (SpillFile, error)
+}
+
+// SpillFile is a file created by a Spiller. Content is only ever appended with Write, and is read back with Read,
+// Seek and ReadAt once writing is done. ReadAt may be called from multiple goroutines at once.
+type SpillFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	// Name identifies the file, for example in error messages
+	Name() string
+	// Remove closes and deletes the file
+	Remove() error
+}
+
+// TempFileSpiller creates temporary files with the standard library's ioutil.TempFile. It is used by OverflowBuffers
+// without a Spiller. Since its files are os.Files, the operating system can transfer content to and from them
+// directly in OverflowBuffer.ReadFrom and OverflowBuffer.WriteTo.
+type TempFileSpiller struct{}
+
+// Spill implements Spiller
+func (TempFileSpiller) Spill(dir, prefix string) (SpillFile, error) {
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return tempFile{f}, nil
+}
+
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Remove() error {
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// MemSpiller holds spilled content in memory. It is meant for tests, in particular of what happens when spilling
+// fails: Spill returns SpillErr, if it is non-nil, and once the files that have been created hold Limit bytes
+// altogether, writes fail as they would on a full disk.
+type MemSpiller struct {
+	SpillErr error
+	Limit    int64
+
+	mu           sync.Mutex
+	files        int
+	used, spills int64
+}
+
+// Spill implements Spiller
+func (s *MemSpiller) Spill(dir, prefix string) (SpillFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.SpillErr != nil {
+		return nil, s.SpillErr
+	}
+	s.files++
+	s.spills++
+	return &memFile{s: s, name: fmt.Sprintf("mem:%s%d", prefix, s.spills)}, nil
+}
+
+// Files returns the number of files that have been created and not yet removed
+func (s *MemSpiller) Files() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files
+}
+
+// Used returns the number of bytes held by files that haven't been removed
+func (s *MemSpiller) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+type memFile struct {
+	s       *MemSpiller
+	name    string
+	data    []byte
+	pos     int64
+	removed bool
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.removed {
+		return 0, os.ErrClosed
+	}
+	n := len(p)
+	if f.s.Limit > 0 && f.s.used+int64(n) > f.s.Limit {
+		n = int(f.s.Limit - f.s.used)
+	}
+	f.data = append(f.data, p[:n]...)
+	f.s.used += int64(n)
+	if n < len(p) {
+		return n, &os.PathError{Op: "write", Path: f.name, Err: errNoSpace}
+	}
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Remove() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.removed {
+		return &os.PathError{Op: "remove", Path: f.name, Err: os.ErrNotExist}
+	}
+	f.removed = true
+	f.s.files--
+	f.s.used -= int64(len(f.data))
+	f.data = nil
+	return nil
+}
+
+// MmapSpiller creates temporary files, like TempFileSpiller, which are memory-mapped so that content is copied to
+// and from them without system calls. Files grow in steps of at least GrowSize bytes, or DefaultMmapGrowSize if it is
+// zero, doubling as they get larger. The disk space for each step is allocated as the file grows, so a file may take
+// up to twice the space of its content; only the content is drawn from the Budget of a buffer. Memory mapping is only
+// supported on Unix systems; elsewhere Spill fails.
+type MmapSpiller struct {
+	GrowSize int64
+}
+
+// DefaultMmapGrowSize is the smallest step by which the files of an MmapSpiller grow when GrowSize is zero
+const DefaultMmapGrowSize = 1 << 20
@@ -0,0 +1,19 @@
+package ioutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate allocates n bytes of f from off, growing it if need be
+func allocate(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, off, n)
+	if err == syscall.EOPNOTSUPP {
+		// not every file system supports fallocate
+		return writeZeros(f, off, n)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package ioutil
+
+import "errors"
+
+// Spill implements Spiller
+func (s MmapSpiller) Spill(dir, prefix string) (SpillFile, error) {
+	return nil, errors.New("memory-mapped spill files are not supported on this system")
+}
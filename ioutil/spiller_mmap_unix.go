@@ -0,0 +1,155 @@
+//go:build unix
+
+package ioutil
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// Spill implements Spiller
+func (s MmapSpiller) Spill(dir, prefix string) (SpillFile, error) {
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	grow := s.GrowSize
+	if grow <= 0 {
+		grow = DefaultMmapGrowSize
+	}
+	return &mmapFile{f: f, grow: grow}, nil
+}
+
+// mmapFile maps f into memory. The file is grown ahead of what is written, so only its first size bytes are content.
+type mmapFile struct {
+	f    *os.File
+	grow int64
+	data []byte
+	size int64
+	pos  int64
+}
+
+func (m *mmapFile) Write(p []byte) (int, error) {
+	if need := m.size + int64(len(p)); need > int64(len(m.data)) {
+		if err := m.remap(need); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(m.data[m.size:], p)
+	m.size += int64(n)
+	return n, nil
+}
+
+// remap grows the file to hold at least need bytes and maps it again
+func (m *mmapFile) remap(need int64) error {
+	length := int64(len(m.data)) * 2
+	if length < m.grow {
+		length = m.grow
+	}
+	for length < need {
+		length *= 2
+	}
+	if int64(int(length)) != length {
+		return &os.PathError{Op: "mmap", Path: m.f.Name(), Err: syscall.EFBIG}
+	}
+
+	// the blocks are allocated rather than left sparse, so that a full disk fails here instead of raising SIGBUS when
+	// the mapping is written to; the old mapping stays valid until then
+	if err := allocate(m.f, int64(len(m.data)), length-int64(len(m.data))); err != nil {
+		return err
+	}
+	if err := m.unmap(); err != nil {
+		return err
+	}
+	data, err := syscall.Mmap(int(m.f.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return &os.PathError{Op: "mmap", Path: m.f.Name(), Err: err}
+	}
+	m.data = data
+	return nil
+}
+
+// writeZeros allocates n bytes of f from off by writing zeros to them
+func writeZeros(f *os.File, off, n int64) error {
+	zeros := make([]byte, 64<<10)
+	for n > 0 {
+		p := zeros
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		if _, err := f.WriteAt(p, off); err != nil {
+			return err
+		}
+		off += int64(len(p))
+		n -= int64(len(p))
+	}
+	return nil
+}
+
+func (m *mmapFile) unmap() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	if err := syscall.Munmap(data); err != nil {
+		return &os.PathError{Op: "munmap", Path: m.f.Name(), Err: err}
+	}
+	return nil
+}
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:m.size])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapFile) Read(p []byte) (int, error) {
+	if m.pos >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.pos:m.size])
+	m.pos += int64(n)
+	return n, nil
+}
+
+func (m *mmapFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += m.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+func (m *mmapFile) Name() string {
+	return m.f.Name()
+}
+
+func (m *mmapFile) Remove() error {
+	err := m.unmap()
+	m.f.Close()
+	if rerr := os.Remove(m.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
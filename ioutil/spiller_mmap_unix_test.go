@@ -0,0 +1,31 @@
+//go:build unix
+
+package ioutil
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMmapSpillerAllocates(t *testing.T) {
+	testName := "TestMmapSpillerAllocates"
+
+	f, err := MmapSpiller{GrowSize: 1 << 16}.Spill("", "mmap")
+	if err != nil {
+		t.Fatalf(testName+" (1): err should be nil, found err == %s", err)
+	}
+	defer f.Remove()
+	if _, err := f.Write([]byte("abc")); err != nil {
+		t.Fatalf(testName+" (2): err should be nil, found err == %s", err)
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatalf(testName+" (3): err should be nil, found err == %s", err)
+	}
+	// the file is grown with its blocks allocated, rather than sparse
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int64(st.Blocks)*512 < fi.Size() {
+		t.Errorf(testName+" (4): expected %d bytes to be allocated, got %d", fi.Size(), int64(st.Blocks)*512)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build unix && !linux
+
+package ioutil
+
+import "os"
+
+// allocate allocates n bytes of f from off, growing it if need be
+func allocate(f *os.File, off, n int64) error {
+	return writeZeros(f, off, n)
+}
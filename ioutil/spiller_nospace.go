@@ -0,0 +1,8 @@
+//go:build !plan9
+
+package ioutil
+
+import "syscall"
+
+// errNoSpace is the error with which writes to a MemSpiller's files fail once its Limit has been reached
+var errNoSpace error = syscall.ENOSPC
@@ -0,0 +1,7 @@
+package ioutil
+
+import "errors"
+
+// errNoSpace is the error with which writes to a MemSpiller's files fail once its Limit has been reached. Plan 9 has
+// no ENOSPC.
+var errNoSpace = errors.New("no space left on device")
@@ -0,0 +1,80 @@
+package ioutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSpillers(t *testing.T) {
+	mem := &MemSpiller{}
+	tests := []struct {
+		spiller           Spiller
+		encrypt, compress bool
+	}{
+		{TempFileSpiller{}, false, false},
+		{mem, false, false},
+		{mem, true, true},
+		{MmapSpiller{GrowSize: 4096}, false, false},
+		{MmapSpiller{}, true, false},
+	}
+
+	p := make([]byte, 10000)
+	rand.Read(p)
+	for i, test := range tests {
+		testName := fmt.Sprintf("TestSpillers loop (%d)", i)
+		ob := &OverflowBuffer{Capacity: 1000, Spiller: test.spiller, Encrypt: test.encrypt, Compress: test.compress}
+		r := fill(t, testName, ob, p, 20)
+
+		b := make([]byte, 100)
+		off := int64(len(r) - 150)
+		if n, err := ob.ReadAt(b, off); n != len(b) || err != nil || !bytes.Equal(b, r[off:off+100]) {
+			t.Errorf(testName+" (1): expected to read %d bytes at %d, got %d and err == %v", len(b), off, n, err)
+		}
+		if _, err := ob.Seek(5000, io.SeekStart); err != nil {
+			t.Errorf(testName+" (2): err should be nil, found err == %s", err)
+		}
+		check(t, testName+" (3)", ob, r[5000:])
+
+		if err := ob.Close(); err != nil {
+			t.Errorf(testName+" (4): err should be nil, found err == %s", err)
+		}
+		if _, err := os.Stat(ob.SpillPath()); !os.IsNotExist(err) {
+			t.Errorf(testName+" (5): expected the backing file to have been removed, found err == %v", err)
+		}
+	}
+
+	if n := mem.Files(); n != 0 {
+		t.Errorf("TestSpillers (6): expected all files to have been removed, %d remain", n)
+	}
+}
+
+func TestMemSpillerFaults(t *testing.T) {
+	testName := "TestMemSpillerFaults"
+	spillErr := errors.New("no volume")
+	mem := &MemSpiller{SpillErr: spillErr}
+
+	ob := &OverflowBuffer{Capacity: 10, Spiller: mem}
+	if n, err := ob.Write(make([]byte, 20)); n != 10 || !errors.Is(err, spillErr) {
+		t.Errorf(testName+" (1): expected 10 bytes to be written before failing with %v, got %d and %v", spillErr, n, err)
+	}
+	ob.Close()
+
+	mem.SpillErr = nil
+	mem.Limit = 100
+	ob = &OverflowBuffer{Capacity: 10, Spiller: mem}
+	if n, err := ob.Write(make([]byte, 200)); n != 110 || !errors.Is(err, errNoSpace) {
+		t.Errorf(testName+" (2): expected 110 bytes to be written before failing with ENOSPC, got %d and %v", n, err)
+	}
+	if used := mem.Used(); used != 100 {
+		t.Errorf(testName+" (3): expected 100 bytes to be used, got %d", used)
+	}
+	ob.Close()
+	if used := mem.Used(); used != 0 {
+		t.Errorf(testName+" (4): expected the space to have been released, got %d bytes used", used)
+	}
+}
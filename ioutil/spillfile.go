@@ -0,0 +1,269 @@
+package ioutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// spillChunkSize is the number of bytes of content that are compressed or encrypted together in a chunked spill file
+const spillChunkSize = 64 << 10
+
+// chunkCodec transforms the chunks of a chunkedFile before they are written to disk and after they are read back.
+// Both methods append their result to dst, which never overlaps p.
+type chunkCodec interface {
+	seal(dst, p []byte, idx int64) []byte
+	open(dst, p []byte, idx int64) ([]byte, error)
+}
+
+// gcmCodec encrypts chunks with AES-GCM, using a random key that is only held in memory and a nonce derived from the
+// index of the chunk, which is why a chunk must only be sealed once
+type gcmCodec struct {
+	aead cipher.AEAD
+}
+
+func newGCMCodec() (*gcmCodec, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmCodec{aead}, nil
+}
+
+func (c *gcmCodec) nonce(idx int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(idx))
+	return nonce
+}
+
+func (c *gcmCodec) seal(dst, p []byte, idx int64) []byte {
+	return c.aead.Seal(dst, c.nonce(idx), p, nil)
+}
+
+func (c *gcmCodec) open(dst, p []byte, idx int64) ([]byte, error) {
+	plain, err := c.aead.Open(dst, c.nonce(idx), p, nil)
+	if err != nil {
+		return nil, errors.New("spill file has been modified")
+	}
+	return plain, nil
+}
+
+// flateCodec compresses chunks with DEFLATE
+type flateCodec struct {
+	w  *flate.Writer
+	r  io.ReadCloser
+	br bytes.Reader
+}
+
+func newFlateCodec(level int) (*flateCodec, error) {
+	w, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &flateCodec{w: w, r: flate.NewReader(nil)}, nil
+}
+
+func (c *flateCodec) seal(dst, p []byte, idx int64) []byte {
+	buf := bytes.NewBuffer(dst)
+	c.w.Reset(buf)
+	// writing to a bytes.Buffer doesn't fail
+	c.w.Write(p)
+	c.w.Close()
+	return buf.Bytes()
+}
+
+func (c *flateCodec) open(dst, p []byte, idx int64) ([]byte, error) {
+	c.br.Reset(p)
+	if err := c.r.(flate.Resetter).Reset(&c.br, nil); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(c.r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkedFile stores what is written to f in chunks of spillChunkSize, each transformed by codecs in turn, so that any
+// part of the content can be read without decoding what precedes it. A chunk is only transformed and written once it
+// is complete; until then it is held in memory.
+type chunkedFile struct {
+	f      SpillFile
+	codecs []chunkCodec
+	// ends holds the offset in f at which each chunk ends and tail is the content that follows the chunks
+	ends []int64
+	tail []byte
+	pos  int64
+	// err is the error that writing a chunk failed with, after which f no longer matches ends
+	err error
+	// scratch holds the intermediate results of the codecs
+	scratch [2][]byte
+
+	// mu guards the most recently decoded chunk, which is kept so that small reads don't decode it again
+	mu       sync.Mutex
+	plain    []byte
+	plainIdx int64
+}
+
+func newChunkedFile(f SpillFile, codecs ...chunkCodec) *chunkedFile {
+	return &chunkedFile{f: f, codecs: codecs, plainIdx: -1}
+}
+
+func (c *chunkedFile) size() int64 {
+	return int64(len(c.ends))*spillChunkSize + int64(len(c.tail))
+}
+
+// stored returns the number of bytes written to f
+func (c *chunkedFile) stored() int64 {
+	if len(c.ends) == 0 {
+		return 0
+	}
+	return c.ends[len(c.ends)-1]
+}
+
+// Write appends p to the content, writing every chunk that it completes
+func (c *chunkedFile) Write(p []byte) (nwrote int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	for len(p) > 0 {
+		n := spillChunkSize - len(c.tail)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.tail = append(c.tail, p[:n]...)
+		if len(c.tail) == spillChunkSize {
+			sealed := c.tail
+			for _, codec := range c.codecs {
+				c.scratch[0] = codec.seal(c.scratch[0][:0], sealed, int64(len(c.ends)))
+				sealed = c.scratch[0]
+				c.scratch[0], c.scratch[1] = c.scratch[1], c.scratch[0]
+			}
+			if _, err = c.f.Write(sealed); err != nil {
+				c.tail = c.tail[:len(c.tail)-n]
+				c.err = err
+				return
+			}
+			c.ends = append(c.ends, c.stored()+int64(len(sealed)))
+			c.tail = c.tail[:0]
+		}
+		nwrote += n
+		p = p[n:]
+	}
+	return
+}
+
+func (c *chunkedFile) ReadAt(p []byte, off int64) (nread int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for nread < len(p) && off < c.size() {
+		idx := off / spillChunkSize
+		var chunk []byte
+		if idx < int64(len(c.ends)) {
+			if chunk, err = c.chunk(idx); err != nil {
+				return
+			}
+		} else {
+			chunk = c.tail
+		}
+		n := copy(p[nread:], chunk[off%spillChunkSize:])
+		nread += n
+		off += int64(n)
+	}
+	if nread < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// chunk returns the decoded content of the chunk with the given index
+func (c *chunkedFile) chunk(idx int64) ([]byte, error) {
+	if idx == c.plainIdx {
+		return c.plain, nil
+	}
+	c.plainIdx = -1
+
+	var start int64
+	if idx > 0 {
+		start = c.ends[idx-1]
+	}
+	sealed := c.scratch[0][:0]
+	if n := int(c.ends[idx] - start); cap(sealed) < n {
+		sealed = make([]byte, n)
+	} else {
+		sealed = sealed[:n]
+	}
+	if _, err := c.f.ReadAt(sealed, start); err != nil {
+		return nil, err
+	}
+	c.scratch[0] = sealed
+
+	for i := len(c.codecs) - 1; i >= 0; i-- {
+		c.scratch[1] = c.scratch[1][:0]
+		opened, err := c.codecs[i].open(c.scratch[1], sealed, idx)
+		if err != nil {
+			return nil, err
+		}
+		sealed = opened
+		c.scratch[0], c.scratch[1] = opened, c.scratch[0]
+	}
+	if len(sealed) != spillChunkSize {
+		return nil, errors.New("spill file has been modified")
+	}
+	c.plain, c.plainIdx = append(c.plain[:0], sealed...), idx
+	return c.plain, nil
+}
+
+func (c *chunkedFile) Read(p []byte) (int, error) {
+	n, err := c.ReadAt(p, c.pos)
+	c.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (c *chunkedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+// Remove removes the file and forgets the codecs, and with them any key, and the content held in memory
+func (c *chunkedFile) Remove() error {
+	c.codecs, c.tail, c.plain, c.plainIdx = nil, nil, nil, -1
+	return c.f.Remove()
+}
+
+func (c *chunkedFile) Name() string {
+	return c.f.Name()
+}